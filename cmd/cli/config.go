@@ -0,0 +1,211 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+// cliConfig is the contents of the configuration file.
+type cliConfig struct {
+	Devices []deviceProfile `hcl:"device,block"`
+}
+
+// deviceProfile is a named set of settings for connecting to a PlanktoScope device.
+type deviceProfile struct {
+	Name       string       `hcl:"name,label"`
+	API        string       `hcl:"api,optional"`
+	InstanceID string       `hcl:"instance_id,optional"`
+	MQTT       *mqttProfile `hcl:"mqtt,block"`
+}
+
+// mqttProfile is the MQTT settings of a device profile. Durations are strings like "10s".
+type mqttProfile struct {
+	Username             string `hcl:"username,optional"`
+	Password             string `hcl:"password,optional"`
+	CredentialsFile      string `hcl:"credentials_file,optional"`
+	CAFile               string `hcl:"ca_file,optional"`
+	CertFile             string `hcl:"cert_file,optional"`
+	KeyFile              string `hcl:"key_file,optional"`
+	InsecureSkipVerify   bool   `hcl:"insecure_skip_verify,optional"`
+	ConnectTimeout       string `hcl:"connect_timeout,optional"`
+	ConnectRetryInterval string `hcl:"connect_retry_interval,optional"`
+	ReconnectInterval    string `hcl:"reconnect_interval,optional"`
+}
+
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't determine user configuration directory")
+	}
+	return filepath.Join(dir, "planktoscope", "config.hcl"), nil
+}
+
+// configPath returns the path of the configuration file specified by the config flag, or the
+// default path if the flag is unset.
+func configPath(c *cli.Context) (path string, explicit bool, err error) {
+	if path = c.Path("config"); path != "" {
+		return path, true, nil
+	}
+	path, err = defaultConfigPath()
+	return path, false, err
+}
+
+// loadConfig loads the configuration file specified by the config flag, or the file at the
+// default path if the flag is unset. A missing file at the default path is treated as an empty
+// configuration.
+func loadConfig(c *cli.Context) (config cliConfig, path string, err error) {
+	path, explicit, err := configPath(c)
+	if err != nil {
+		return cliConfig{}, "", err
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return cliConfig{}, path, nil
+		}
+		return cliConfig{}, path, errors.Wrapf(err, "couldn't read configuration file %s", path)
+	}
+	file, diags := hclsyntax.ParseConfig(src, path, hcl.InitialPos)
+	if diags.HasErrors() {
+		return cliConfig{}, path, errors.Wrapf(diags, "couldn't parse configuration file %s", path)
+	}
+	if diags = gohcl.DecodeBody(file.Body, nil, &config); diags.HasErrors() {
+		return cliConfig{}, path, errors.Wrapf(diags, "couldn't decode configuration file %s", path)
+	}
+	return config, path, nil
+}
+
+func (c cliConfig) device(name string) (profile deviceProfile, ok bool) {
+	for _, d := range c.Devices {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return deviceProfile{}, false
+}
+
+// getDeviceProfile returns the device profile selected by the device flag, or nil if no profile
+// was selected.
+func getDeviceProfile(c *cli.Context) (*deviceProfile, error) {
+	name := c.String("device")
+	if name == "" {
+		return nil, nil
+	}
+	config, path, err := loadConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := config.device(name)
+	if !ok {
+		return nil, errors.Errorf("couldn't find device %s in configuration file %s", name, path)
+	}
+	return &profile, nil
+}
+
+// addDeviceProfiles appends device profiles to the configuration file at the path, creating the
+// file if it doesn't exist yet. Profiles with the same names as existing profiles aren't added.
+// The names of the profiles which were added are returned.
+func addDeviceProfiles(path string, profiles []deviceProfile) (added []string, err error) {
+	src, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Wrapf(err, "couldn't read configuration file %s", path)
+	}
+	var existing cliConfig
+	if len(src) > 0 {
+		parsed, diags := hclsyntax.ParseConfig(src, path, hcl.InitialPos)
+		if diags.HasErrors() {
+			return nil, errors.Wrapf(diags, "couldn't parse configuration file %s", path)
+		}
+		if diags = gohcl.DecodeBody(parsed.Body, nil, &existing); diags.HasErrors() {
+			return nil, errors.Wrapf(diags, "couldn't decode configuration file %s", path)
+		}
+	}
+	// We edit the file with hclwrite so that existing comments and formatting are preserved
+	file, diags := hclwrite.ParseConfig(src, path, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, errors.Wrapf(diags, "couldn't parse configuration file %s", path)
+	}
+
+	body := file.Body()
+	for _, profile := range profiles {
+		if _, ok := existing.device(profile.Name); ok {
+			continue
+		}
+		if len(body.Attributes())+len(body.Blocks()) > 0 {
+			body.AppendNewline()
+		}
+		block := body.AppendNewBlock("device", []string{profile.Name}).Body()
+		block.SetAttributeValue("api", cty.StringVal(profile.API))
+		if profile.InstanceID != "" {
+			block.SetAttributeValue("instance_id", cty.StringVal(profile.InstanceID))
+		}
+		existing.Devices = append(existing.Devices, profile)
+		added = append(added, profile.Name)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	const (
+		dirPerm  = 0o755
+		filePerm = 0o600 // profiles may contain credentials
+	)
+	if err = os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return nil, errors.Wrapf(err, "couldn't make directory for configuration file %s", path)
+	}
+	if err = os.WriteFile(path, file.Bytes(), filePerm); err != nil {
+		return nil, errors.Wrapf(err, "couldn't write configuration file %s", path)
+	}
+	return added, nil
+}
+
+// apply overrides the settings with any settings specified by the profile, except for its
+// credentials, which are resolved together with the credentials from flags.
+func (p *mqttProfile) apply(s planktoscope.MQTTSettings) (planktoscope.MQTTSettings, error) {
+	if p == nil {
+		return s, nil
+	}
+	if p.CAFile != "" {
+		s.CAFile = p.CAFile
+	}
+	if p.CertFile != "" {
+		s.CertFile = p.CertFile
+	}
+	if p.KeyFile != "" {
+		s.KeyFile = p.KeyFile
+	}
+	if p.InsecureSkipVerify {
+		s.InsecureSkipVerify = true
+	}
+	durations := []struct {
+		name     string
+		raw      string
+		duration *time.Duration
+	}{
+		{name: "connect_timeout", raw: p.ConnectTimeout, duration: &s.ConnectTimeout},
+		{name: "connect_retry_interval", raw: p.ConnectRetryInterval, duration: &s.ConnectRetryInterval},
+		{name: "reconnect_interval", raw: p.ReconnectInterval, duration: &s.ReconnectInterval},
+	}
+	for _, d := range durations {
+		if d.raw == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.raw)
+		if err != nil {
+			return planktoscope.MQTTSettings{}, errors.Wrapf(err, "couldn't parse %s", d.name)
+		}
+		*d.duration = parsed
+	}
+	return s, nil
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/atrox/haikunatorgo"
 	"github.com/labstack/gommon/log"
@@ -22,39 +23,216 @@ func makeClientID(instanceID string) string {
 	return fmt.Sprintf("planktoscope/cli/%s", instanceID)
 }
 
-func makeConnectedClient(c *cli.Context) (*planktoscope.Client, planktoscope.Logger, error) {
+// makeLogger makes a logger at the log level selected by the log-level flag. Logs are written to
+// stderr, so that stdout only carries printed output (which may be machine-readable).
+func makeLogger(c *cli.Context, name string) *log.Logger {
+	logger := log.New(name)
+	logger.SetOutput(os.Stderr)
+	logger.SetLevel(log.Lvl(c.Uint64("log-level")))
+	return logger
+}
+
+// makeMQTTSettings makes MQTT settings from the flags (including their environment variables),
+// falling back to the device profile's settings and then to the default settings. The username
+// and password are each taken from the first of these sources to set them: the flags, the
+// flags' credentials file, the profile, and the profile's credentials file.
+func makeMQTTSettings(c *cli.Context, profile *deviceProfile) (planktoscope.MQTTSettings, error) {
+	var mqttProfile *mqttProfile
+	if profile != nil {
+		mqttProfile = profile.MQTT
+	}
+	settings, err := mqttProfile.apply(planktoscope.DefaultMQTTSettings())
+	if err != nil {
+		return planktoscope.MQTTSettings{}, errors.Wrapf(
+			err, "couldn't apply MQTT settings of device %s", profile.Name,
+		)
+	}
+
+	if c.IsSet("mqtt-ca-file") {
+		settings.CAFile = c.Path("mqtt-ca-file")
+	}
+	if c.IsSet("mqtt-cert-file") {
+		settings.CertFile = c.Path("mqtt-cert-file")
+	}
+	if c.IsSet("mqtt-key-file") {
+		settings.KeyFile = c.Path("mqtt-key-file")
+	}
+	if c.IsSet("mqtt-insecure-skip-verify") {
+		settings.InsecureSkipVerify = c.Bool("mqtt-insecure-skip-verify")
+	}
+	if c.IsSet("mqtt-connect-timeout") {
+		settings.ConnectTimeout = time.Duration(c.Uint64("mqtt-connect-timeout")) * time.Second
+	}
+	if c.IsSet("mqtt-connect-retry-interval") {
+		settings.ConnectRetryInterval = time.Duration(
+			c.Uint64("mqtt-connect-retry-interval"),
+		) * time.Second
+	}
+	if c.IsSet("mqtt-reconnect-interval") {
+		settings.ReconnectInterval = time.Duration(c.Uint64("mqtt-reconnect-interval")) * time.Second
+	}
+
+	settings.Username = c.String("mqtt-username")
+	settings.Password = c.String("mqtt-password")
+	if settings, err = withCredentialsFile(settings, c.Path("mqtt-credentials-file")); err != nil {
+		return planktoscope.MQTTSettings{}, err
+	}
+	if mqttProfile != nil {
+		settings = settings.WithCredentials(planktoscope.MQTTCredentials{
+			Username: mqttProfile.Username,
+			Password: mqttProfile.Password,
+		})
+		if settings, err = withCredentialsFile(settings, mqttProfile.CredentialsFile); err != nil {
+			return planktoscope.MQTTSettings{}, err
+		}
+	}
+	return settings, nil
+}
+
+// withCredentialsFile sets any credentials missing from the settings with the credentials from
+// the file at the path, if a path is specified.
+func withCredentialsFile(
+	s planktoscope.MQTTSettings, path string,
+) (planktoscope.MQTTSettings, error) {
+	if path == "" {
+		return s, nil
+	}
+	credentials, err := planktoscope.ReadMQTTCredentials(path)
+	if err != nil {
+		return planktoscope.MQTTSettings{}, errors.Wrap(err, "couldn't read MQTT credentials file")
+	}
+	return s.WithCredentials(credentials), nil
+}
+
+// makeClient makes a client for the device profile selected by the device flag, if any.
+func makeClient(
+	c *cli.Context, options ...planktoscope.ClientOption,
+) (*planktoscope.Client, planktoscope.Logger, error) {
+	profile, err := getDeviceProfile(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := makePrinter(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return makeDeviceClient(c, profile, p, options...)
+}
+
+// makeDeviceClient makes a client for the device profile, with any settings from flags taking
+// precedence over the profile's settings, and with a logger named after the profile. If the
+// profile is nil, only settings from flags are used. If the dry-run flag is set, commands are
+// printed with the printer instead of being sent. The client is made with any options provided.
+func makeDeviceClient(
+	c *cli.Context, profile *deviceProfile, p *printer, options ...planktoscope.ClientOption,
+) (*planktoscope.Client, planktoscope.Logger, error) {
 	apiURL := c.String("api")
-	clientID := makeClientID(c.String("instance-id"))
-	config, err := planktoscope.GetConfig(apiURL, clientID)
+	instanceID := c.String("instance-id")
+	if profile != nil {
+		if profile.API != "" && !c.IsSet("api") {
+			apiURL = profile.API
+		}
+		if profile.InstanceID != "" && !c.IsSet("instance-id") {
+			instanceID = profile.InstanceID
+		}
+	}
+	clientID := makeClientID(instanceID)
+	settings, err := makeMQTTSettings(c, profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := planktoscope.NewConfig(apiURL, clientID, settings)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "couldn't make MQTT client config")
 	}
-	logger := log.New(clientID)
-	logger.SetLevel(log.Lvl(c.Uint64("log-level")))
-	client, err := planktoscope.NewClient(config, logger)
+	loggerName := clientID
+	if profile != nil && profile.Name != "" {
+		loggerName = profile.Name
+	}
+	logger := makeLogger(c, loggerName)
+	if c.Bool("dry-run") {
+		logger.Infof("Dry run: commands will be printed instead of being sent to %s", apiURL)
+		options = append(options, planktoscope.WithDryRun(func(m planktoscope.RawMessage) {
+			if err := p.printCommand(m); err != nil {
+				logger.Error(errors.Wrap(err, "couldn't print command"))
+			}
+		}))
+	}
+	client, err := planktoscope.NewClient(config, logger, options...)
 	if err != nil {
 		return nil, logger, errors.Wrapf(err, "couldn't make client for %s", apiURL)
 	}
+	return client, logger, nil
+}
 
+func connectClient(client *planktoscope.Client, logger planktoscope.Logger) error {
+	apiURL := client.Config.URL
+	if client.DryRun() {
+		// No broker is contacted in a dry run, so we shouldn't claim to connect to one
+		return errors.Wrap(client.Connect(), "couldn't start dry run")
+	}
 	logger.Infof("Connecting to %s", apiURL)
 	if err := client.Connect(); err != nil {
-		return client, logger, errors.Wrapf(err, "couldn't connect to %s", apiURL)
+		return errors.Wrapf(err, "couldn't connect to %s", apiURL)
 	}
 	logger.Infof("Connected to %s", apiURL)
-	return client, logger, nil
+	return nil
 }
 
-func listenAll(ctx context.Context, client *planktoscope.Client) {
+func makeConnectedClient(c *cli.Context) (*planktoscope.Client, planktoscope.Logger, error) {
+	client, logger, err := makeClient(c)
+	if err != nil {
+		return client, logger, err
+	}
+	return client, logger, connectClient(client, logger)
+}
+
+func closeClient(client *planktoscope.Client, logger planktoscope.Logger) {
+	if !client.DryRun() {
+		logger.Infof("Closing connection to %s...", client.Config.URL)
+	}
+	if err := client.Shutdown(context.Background()); err != nil {
+		client.Close()
+	}
+}
+
+const (
+	forwardDirection  = "forward"
+	backwardDirection = "backward"
+)
+
+func parseDirection(direction string) (forward bool, err error) {
+	switch direction {
+	default:
+		return false, errors.Errorf(
+			"unknown direction %s (must be %s or %s)", direction, forwardDirection, backwardDirection,
+		)
+	case forwardDirection:
+		return true, nil
+	case backwardDirection:
+		return false, nil
+	}
+}
+
+func listenAll(ctx context.Context, client *planktoscope.Client, p *printer) error {
 	for {
+		var err error
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		case <-client.PumpStateBroadcasted():
-			fmt.Printf("%+v\n", client.GetState().Pump)
+			err = p.printState(pumpSubsystem, client.GetState().Pump)
 		case <-client.CameraStateBroadcasted():
-			fmt.Printf("%+v\n", client.GetState().CameraSettings)
+			err = p.printState(cameraSubsystem, client.GetState().CameraSettings)
 		case <-client.ImagerStateBroadcasted():
-			fmt.Printf("%+v\n", client.GetState().Imager)
+			err = p.printState(imagerSubsystem, client.GetState().Imager)
+		case <-client.SegmenterStateBroadcasted():
+			err = p.printState(segmenterSubsystem, client.GetState().Segmenter)
+		case <-client.ConnectionStateBroadcasted():
+			err = p.printState(connectionSubsystem, client.GetState().Connection)
+		}
+		if err != nil {
+			return errors.Wrap(err, "couldn't print state update")
 		}
 	}
 }
@@ -62,6 +240,10 @@ func listenAll(ctx context.Context, client *planktoscope.Client) {
 // listen
 
 func devListenAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
 	client, logger, err := makeConnectedClient(c)
 	if err != nil {
 		return err
@@ -70,33 +252,39 @@ func devListenAction(c *cli.Context) error {
 	ctxRun, cancelRun := signal.NotifyContext(
 		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
 	)
-	listenAll(ctxRun, client)
+	err = listenAll(ctxRun, client, p)
 	cancelRun()
 
-	logger.Info("Closing connection...")
-	err = client.Shutdown(context.Background())
-	if err != nil {
-		client.Close()
-	}
-	return nil
+	closeClient(client, logger)
+	return err
 }
 
 // hal listen
 
-func listenHAL(ctx context.Context, client *planktoscope.Client) {
+func listenHAL(ctx context.Context, client *planktoscope.Client, p *printer) error {
 	for {
+		var err error
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		case <-client.PumpStateBroadcasted():
-			fmt.Printf("%+v\n", client.GetState().Pump)
+			err = p.printState(pumpSubsystem, client.GetState().Pump)
 		case <-client.CameraStateBroadcasted():
-			fmt.Printf("%+v\n", client.GetState().CameraSettings)
+			err = p.printState(cameraSubsystem, client.GetState().CameraSettings)
+		case <-client.ConnectionStateBroadcasted():
+			err = p.printState(connectionSubsystem, client.GetState().Connection)
+		}
+		if err != nil {
+			return errors.Wrap(err, "couldn't print state update")
 		}
 	}
 }
 
 func devHALListenAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
 	client, logger, err := makeConnectedClient(c)
 	if err != nil {
 		return err
@@ -105,31 +293,215 @@ func devHALListenAction(c *cli.Context) error {
 	ctxRun, cancelRun := signal.NotifyContext(
 		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
 	)
-	listenHAL(ctxRun, client)
+	err = listenHAL(ctxRun, client, p)
 	cancelRun()
 
-	logger.Info("Closing connection...")
-	err = client.Shutdown(context.Background())
+	closeClient(client, logger)
+	return err
+}
+
+// hal pump start
+
+func devHALPumpStartAction(c *cli.Context) error {
+	forward, err := parseDirection(c.String("direction"))
 	if err != nil {
-		client.Close()
+		return err
 	}
-	return nil
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	err = startPump(ctxRun, c, client, logger, forward)
+	cancelRun()
+
+	closeClient(client, logger)
+	return errors.Wrap(err, "couldn't run pump")
+}
+
+func startPump(
+	ctx context.Context, c *cli.Context, client *planktoscope.Client, logger planktoscope.Logger,
+	forward bool,
+) error {
+	params := planktoscope.PlanktoscopePumpParams{
+		Forward: forward, Volume: c.Float64("volume"), Flowrate: c.Float64("flowrate"),
+	}
+	logger.Info("starting pump...")
+	switch {
+	default:
+		token, err := client.StartPump(params.Forward, params.Volume, params.Flowrate)
+		if err != nil {
+			return errors.Wrap(err, "couldn't send command to start the pump")
+		}
+		token.Wait()
+		return token.Error()
+	case c.Bool("await-finished"):
+		result, err := client.RunPumpActionToCompletion(ctx, params)
+		if err != nil || client.DryRun() {
+			return err
+		}
+		logger.Infof("Pump has finished after %s!", result.End.Sub(result.Start))
+		return nil
+	case c.Bool("await-started"):
+		if err := client.RunPumpAction(ctx, params); err != nil || client.DryRun() {
+			return err
+		}
+		if state := client.GetState().Pump; state.Pumping {
+			logger.Infof("Pump has started! Expected duration: %s", state.Duration)
+		}
+		return nil
+	}
+}
+
+// hal pump stop
+
+func devHALPumpStopAction(c *cli.Context) error {
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("stopping pump...")
+	err = stopPump(client)
+	closeClient(client, logger)
+	return errors.Wrap(err, "couldn't stop pump")
+}
+
+func stopPump(client *planktoscope.Client) error {
+	token, err := client.StopPump()
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to stop the pump")
+	}
+	token.Wait()
+	return token.Error()
+}
+
+// hal camera get
+
+func devHALCameraGetAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	ctxWait, cancelWait := ctxRun, func() {}
+	if timeout := c.Duration("timeout"); timeout > 0 {
+		ctxWait, cancelWait = context.WithTimeout(ctxRun, timeout)
+	}
+	settings, err := awaitCameraSettings(ctxWait, client)
+	cancelWait()
+	cancelRun()
+
+	closeClient(client, logger)
+	if err != nil {
+		return errors.Wrap(err, "couldn't determine camera settings")
+	}
+	return p.printState(cameraSubsystem, settings)
+}
+
+func awaitCameraSettings(
+	ctx context.Context, client *planktoscope.Client,
+) (planktoscope.CameraSettings, error) {
+	for {
+		stateUpdated := client.CameraStateBroadcasted()
+		if settings := client.GetState().CameraSettings; settings.StateKnown {
+			return settings, nil
+		}
+		select {
+		case <-ctx.Done():
+			return planktoscope.CameraSettings{}, ctx.Err()
+		case <-stateUpdated:
+		}
+	}
+}
+
+// hal camera set
+
+const (
+	autoWhiteBalance   = "auto"
+	manualWhiteBalance = "manual"
+)
+
+func parseCameraSettings(c *cli.Context) (settings planktoscope.CameraSettings, err error) {
+	settings.ISO = c.Uint64("iso")
+	settings.ShutterSpeed = c.Uint64("shutter-speed")
+	switch whiteBalance := c.String("white-balance"); whiteBalance {
+	default:
+		return planktoscope.CameraSettings{}, errors.Errorf(
+			"unknown white balance mode %s (must be %s or %s)",
+			whiteBalance, autoWhiteBalance, manualWhiteBalance,
+		)
+	case autoWhiteBalance:
+		settings.AutoWhiteBalance = true
+	case manualWhiteBalance:
+		settings.AutoWhiteBalance = false
+	}
+	settings.WhiteBalanceRedGain = c.Float64("red-gain")
+	settings.WhiteBalanceBlueGain = c.Float64("blue-gain")
+	return settings, planktoscope.ValidateCameraSettings(settings)
+}
+
+func devHALCameraSetAction(c *cli.Context) error {
+	settings, err := parseCameraSettings(c)
+	if err != nil {
+		return errors.Wrap(err, "invalid camera settings")
+	}
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("changing camera settings...")
+	err = setCamera(client, settings)
+	closeClient(client, logger)
+	return errors.Wrap(err, "couldn't change camera settings")
+}
+
+func setCamera(client *planktoscope.Client, s planktoscope.CameraSettings) error {
+	token, err := client.SetCamera(
+		s.ISO, s.ShutterSpeed, s.AutoWhiteBalance, s.WhiteBalanceRedGain, s.WhiteBalanceBlueGain,
+	)
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to change camera settings")
+	}
+	token.Wait()
+	return token.Error()
 }
 
 // ctl listen
 
-func listenCtl(ctx context.Context, client *planktoscope.Client) {
+func listenCtl(ctx context.Context, client *planktoscope.Client, p *printer) error {
 	for {
+		var err error
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		case <-client.ImagerStateBroadcasted():
-			fmt.Printf("%+v\n", client.GetState().Imager)
+			err = p.printState(imagerSubsystem, client.GetState().Imager)
+		case <-client.ConnectionStateBroadcasted():
+			err = p.printState(connectionSubsystem, client.GetState().Connection)
+		}
+		if err != nil {
+			return errors.Wrap(err, "couldn't print state update")
 		}
 	}
 }
 
 func devCtlListenAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
 	client, logger, err := makeConnectedClient(c)
 	if err != nil {
 		return err
@@ -138,31 +510,171 @@ func devCtlListenAction(c *cli.Context) error {
 	ctxRun, cancelRun := signal.NotifyContext(
 		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
 	)
-	listenCtl(ctxRun, client)
+	err = listenCtl(ctxRun, client, p)
 	cancelRun()
 
-	logger.Info("Closing connection...")
-	err = client.Shutdown(context.Background())
+	closeClient(client, logger)
+	return err
+}
+
+// ctl image start
+
+func devCtlImageStartAction(c *cli.Context) error {
+	forward, err := parseDirection(c.String("direction"))
 	if err != nil {
-		client.Close()
+		return err
+	}
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	err = startImaging(ctxRun, c, client, logger, forward)
+	cancelRun()
+
+	closeClient(client, logger)
+	return errors.Wrap(err, "couldn't run image acquisition routine")
+}
+
+func startImaging(
+	ctx context.Context, c *cli.Context, client *planktoscope.Client, logger planktoscope.Logger,
+	forward bool,
+) error {
+	logger.Info("setting sample metadata...")
+	token, err := client.SetMetadata(c.String("sample-project-id"), c.String("sample-id"), time.Now())
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to set sample metadata")
+	}
+	if token.Wait(); token.Error() != nil {
+		return token.Error()
+	}
+
+	logger.Info("starting image acquisition...")
+	token, err = client.StartImaging(
+		forward, c.Float64("step-volume"), c.Float64("step-delay"), c.Uint64("steps"),
+	)
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to start imaging")
+	}
+	if token.Wait(); token.Error() != nil {
+		return token.Error()
+	}
+
+	if client.DryRun() {
+		return nil
+	}
+	err = listenStartImaging(ctx, client, logger, c.Bool("await-started"), c.Bool("await-finished"))
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	// The device keeps acquiring images even after we disconnect, so we must stop it explicitly
+	logger.Warn("Stopping image acquisition because we were interrupted...")
+	if err := stopImaging(client); err != nil {
+		return errors.Wrap(err, "couldn't stop image acquisition after interruption")
+	}
+	return errors.Wrap(ctx.Err(), "image acquisition was stopped")
+}
+
+func listenStartImaging(
+	ctx context.Context, client *planktoscope.Client, logger planktoscope.Logger,
+	awaitStarted, awaitFinished bool,
+) error {
+	if !awaitStarted && !awaitFinished {
+		return nil
+	}
+
+	imaging := false
+	var frame uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-client.ImagerStateBroadcasted():
+			prevImaging := imaging
+			state := client.GetState().Imager
+			logger.Debugf("State updated: %+v\n", state)
+			if !state.StateKnown {
+				break
+			}
+			imaging = state.Imaging
+			if !prevImaging && imaging {
+				logger.Info("Image acquisition has started!")
+				if awaitStarted && !awaitFinished {
+					logger.Info("Quitting because image acquisition started!")
+					return nil
+				}
+			}
+			if imaging && state.CurrentFrame != frame {
+				frame = state.CurrentFrame
+				logger.Infof("Acquired frame %d/%d", state.CurrentFrame, state.TotalFrames)
+			}
+			if prevImaging && !imaging {
+				if state.Interrupted {
+					return errors.Errorf(
+						"image acquisition was interrupted after %d frames", state.CurrentFrame,
+					)
+				}
+				logger.Info("Image acquisition has finished!")
+				if awaitFinished {
+					logger.Info("Quitting because image acquisition finished!")
+					logger.Infof("Total acquired frames: %d\n", state.CurrentFrame)
+					return nil
+				}
+			}
+		}
 	}
-	return nil
+}
+
+// ctl image stop
+
+func devCtlImageStopAction(c *cli.Context) error {
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("stopping image acquisition...")
+	err = stopImaging(client)
+	closeClient(client, logger)
+	return errors.Wrap(err, "couldn't stop image acquisition")
+}
+
+func stopImaging(client *planktoscope.Client) error {
+	token, err := client.StopImaging()
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to stop imaging")
+	}
+	token.Wait()
+	return token.Error()
 }
 
 // proc listen
 
-func listenProc(ctx context.Context, client *planktoscope.Client) {
+func listenProc(ctx context.Context, client *planktoscope.Client, p *printer) error {
 	for {
+		var err error
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		case <-client.SegmenterStateBroadcasted():
-			fmt.Printf("%+v\n", client.GetState().Segmenter)
+			err = p.printState(segmenterSubsystem, client.GetState().Segmenter)
+		case <-client.ConnectionStateBroadcasted():
+			err = p.printState(connectionSubsystem, client.GetState().Connection)
+		}
+		if err != nil {
+			return errors.Wrap(err, "couldn't print state update")
 		}
 	}
 }
 
 func devProcListenAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
 	client, logger, err := makeConnectedClient(c)
 	if err != nil {
 		return err
@@ -171,15 +683,11 @@ func devProcListenAction(c *cli.Context) error {
 	ctxRun, cancelRun := signal.NotifyContext(
 		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
 	)
-	listenProc(ctxRun, client)
+	err = listenProc(ctxRun, client, p)
 	cancelRun()
 
-	logger.Infof("Closing connection to %s...", client.Config.URL)
-	err = client.Shutdown(context.Background())
-	if err != nil {
-		client.Close()
-	}
-	return nil
+	closeClient(client, logger)
+	return err
 }
 
 // proc start
@@ -193,17 +701,11 @@ func devProcStartAction(c *cli.Context) error {
 	ctxRun, cancelRun := signal.NotifyContext(
 		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
 	)
-	if err = startProc(ctxRun, c, client, logger); err != nil {
-		return errors.Wrap(err, "couldn't start data processing routine")
-	}
+	err = startProc(ctxRun, c, client, logger)
 	cancelRun()
 
-	logger.Infof("Closing connection to %s...", client.Config.URL)
-	err = client.Shutdown(context.Background())
-	if err != nil {
-		client.Close()
-	}
-	return nil
+	closeClient(client, logger)
+	return errors.Wrap(err, "couldn't start data processing routine")
 }
 
 func startProc(
@@ -221,7 +723,18 @@ func startProc(
 		return token.Error()
 	}
 
-	return listenStartProc(ctx, client, logger, c.Bool("await-started"), c.Bool("await-finished"))
+	if client.DryRun() {
+		return nil
+	}
+	err = listenStartProc(ctx, client, logger, c.Bool("await-started"), c.Bool("await-finished"))
+	if err == nil || ctx.Err() == nil || !c.Bool("stop-on-interrupt") {
+		return err
+	}
+	logger.Warn("Stopping segmentation because we were interrupted...")
+	if err := stopProc(client); err != nil {
+		return errors.Wrap(err, "couldn't stop segmentation after interruption")
+	}
+	return errors.Wrap(ctx.Err(), "segmentation was stopped")
 }
 
 func listenStartProc(
@@ -257,6 +770,11 @@ func listenStartProc(
 				}
 			}
 			if finished {
+				if state.Interrupted {
+					return errors.Errorf(
+						"segmentation was interrupted after %d objects", state.LastObject+1,
+					)
+				}
 				logger.Info("Segmentation has finished!")
 				if awaitFinished {
 					logger.Info("Quitting because segmentation finished!")
@@ -267,3 +785,26 @@ func listenStartProc(
 		}
 	}
 }
+
+// proc stop
+
+func devProcStopAction(c *cli.Context) error {
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("stopping segmentation...")
+	err = stopProc(client)
+	closeClient(client, logger)
+	return errors.Wrap(err, "couldn't stop data processing routine")
+}
+
+func stopProc(client *planktoscope.Client) error {
+	token, err := client.StopSegmenting()
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to stop segmenting")
+	}
+	token.Wait()
+	return token.Error()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/discovery"
+)
+
+func discoverAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	options := discovery.DefaultOptions()
+	options.HostPrefix = c.String("prefix")
+	const maxPort = 65535
+	port := c.Uint64("port")
+	if port == 0 || port > maxPort {
+		return errors.Errorf("invalid port %d", port)
+	}
+	options.MQTTPort = uint16(port)
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	ctxBrowse, cancelBrowse := context.WithTimeout(ctxRun, c.Duration("timeout"))
+	hosts, err := discovery.Discover(ctxBrowse, options)
+	cancelBrowse()
+	cancelRun()
+	if err != nil {
+		return errors.Wrap(err, "couldn't discover PlanktoScopes")
+	}
+
+	if err = printHosts(p, hosts); err != nil {
+		return errors.Wrap(err, "couldn't print discovered PlanktoScopes")
+	}
+	if !c.Bool("save") {
+		return nil
+	}
+	return saveHosts(c, hosts)
+}
+
+func printHosts(p *printer, hosts []discovery.Host) error {
+	switch p.format {
+	case jsonOutput:
+		return p.printValue(hosts)
+	case ndjsonOutput:
+		for _, host := range hosts {
+			if err := p.printValue(host); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	p.wL.Lock()
+	defer p.wL.Unlock()
+
+	if len(hosts) == 0 {
+		_, err := fmt.Fprintln(p.w, "No PlanktoScopes found")
+		return err
+	}
+	const (
+		minWidth = 0
+		tabWidth = 8
+		padding  = 2
+	)
+	w := tabwriter.NewWriter(p.w, minWidth, tabWidth, padding, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHOSTNAME\tADDRESSES\tAPI")
+	for _, host := range hosts {
+		addresses := make([]string, 0, len(host.Addresses))
+		for _, address := range host.Addresses {
+			addresses = append(addresses, address.String())
+		}
+		api := host.API
+		if api == "" {
+			api = "unreachable"
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\n", host.Name(), host.Hostname, strings.Join(addresses, ", "), api,
+		)
+	}
+	return w.Flush()
+}
+
+// saveHosts adds a device profile for each reachable host to the configuration file.
+func saveHosts(c *cli.Context, hosts []discovery.Host) error {
+	path, _, err := configPath(c)
+	if err != nil {
+		return err
+	}
+	profiles := make([]deviceProfile, 0, len(hosts))
+	for _, host := range hosts {
+		if host.API == "" {
+			continue
+		}
+		profiles = append(profiles, deviceProfile{Name: host.Name(), API: host.API})
+	}
+	added, err := addDeviceProfiles(path, profiles)
+	if err != nil {
+		return errors.Wrap(err, "couldn't save device profiles")
+	}
+	if len(added) == 0 {
+		fmt.Fprintf(os.Stderr, "No new device profiles to save to %s\n", path)
+		return nil
+	}
+	fmt.Fprintf(
+		os.Stderr, "Saved device profiles to %s: %s\n", path, strings.Join(added, ", "),
+	)
+	return nil
+}
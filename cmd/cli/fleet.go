@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+// getFleetDevices returns the device profiles selected by the device and all flags. Devices which
+// are specified by API URLs rather than profile names are named by the host in the URL.
+func getFleetDevices(c *cli.Context) ([]deviceProfile, error) {
+	config, path, err := loadConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	var devices []deviceProfile
+	if c.Bool("all") {
+		devices = append(devices, config.Devices...)
+	}
+	for _, device := range c.StringSlice("device") {
+		if strings.Contains(device, "://") {
+			parsed, err := url.Parse(device)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't parse API URL %s", device)
+			}
+			devices = append(devices, deviceProfile{Name: parsed.Host, API: device})
+			continue
+		}
+		profile, ok := config.device(device)
+		if !ok {
+			return nil, errors.Errorf("couldn't find device %s in configuration file %s", device, path)
+		}
+		devices = append(devices, profile)
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("no devices were specified")
+	}
+
+	names := make(map[string]struct{})
+	// Fleet commands have no api flag to fall back on, so every profile must specify its API URL
+	var missingAPI []string
+	for _, device := range devices {
+		if _, ok := names[device.Name]; ok {
+			return nil, errors.Errorf("device %s was specified more than once", device.Name)
+		}
+		names[device.Name] = struct{}{}
+		if device.API == "" {
+			missingAPI = append(missingAPI, device.Name)
+		}
+	}
+	if len(missingAPI) > 0 {
+		return nil, errors.Errorf(
+			"no api URL is set for device %s in configuration file %s",
+			strings.Join(missingAPI, ", "), path,
+		)
+	}
+	return devices, nil
+}
+
+// connectClientContext connects the client, giving up once the context is done. This is needed
+// because the client retries its connection indefinitely, so a fleet command would otherwise wait
+// forever for an unreachable device.
+func connectClientContext(
+	ctx context.Context, client *planktoscope.Client, logger planktoscope.Logger,
+) error {
+	connected := make(chan error, 1)
+	go func() {
+		connected <- connectClient(client, logger)
+	}()
+	select {
+	case err := <-connected:
+		return err
+	case <-ctx.Done():
+	}
+	// Disconnecting stops the client from retrying its connection, so that the connecting goroutine
+	// returns after its current attempt instead of trying to connect forever in the background.
+	// We don't wait for it, since the attempt may take as long as the connect retry interval.
+	client.Transport.Disconnect(0)
+	return errors.Wrapf(ctx.Err(), "couldn't connect to %s", client.Config.URL)
+}
+
+// fleetResult is the result of running a command on one device of a fleet.
+type fleetResult struct {
+	Device string `json:"device"`
+	API    string `json:"api"`
+	Error  string `json:"error,omitempty"`
+}
+
+// fleetSummary is the machine-readable representation of the results of running a command on
+// every device of a fleet.
+type fleetSummary struct {
+	Results []fleetResult `json:"results"`
+}
+
+// runFleet concurrently connects to each device and runs the operation on it, and returns the
+// results in the order of the devices. In a dry run, the commands for each device are printed with
+// the printer, labeled with the device's name.
+func runFleet(
+	ctx context.Context, c *cli.Context, p *printer, devices []deviceProfile,
+	run func(ctx context.Context, device deviceProfile, client *planktoscope.Client) error,
+) []fleetResult {
+	results := make([]fleetResult, len(devices))
+	wg := &sync.WaitGroup{}
+	for i, device := range devices {
+		i, device := i, device
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			results[i] = fleetResult{Device: device.Name, API: device.API}
+			if err := runFleetDevice(ctx, c, device, p.forDevice(device.Name), run); err != nil {
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func runFleetDevice(
+	ctx context.Context, c *cli.Context, device deviceProfile, p *printer,
+	run func(ctx context.Context, device deviceProfile, client *planktoscope.Client) error,
+) error {
+	client, logger, err := makeDeviceClient(c, &device, p)
+	if err != nil {
+		return err
+	}
+	if err = connectClientContext(ctx, client, logger); err != nil {
+		client.Close()
+		return err
+	}
+	err = run(ctx, device, client)
+	closeClient(client, logger)
+	return err
+}
+
+// printFleetSummary prints the results of running a command on every device of a fleet, and
+// returns an error if the command failed on any device.
+func printFleetSummary(p *printer, results []fleetResult) error {
+	if p.format != textOutput {
+		if err := p.printValue(fleetSummary{Results: results}); err != nil {
+			return errors.Wrap(err, "couldn't print summary")
+		}
+	} else if err := printFleetSummaryTable(p, results); err != nil {
+		return errors.Wrap(err, "couldn't print summary")
+	}
+	return checkFleetResults(results)
+}
+
+// checkFleetResults returns an error if the command failed on any device.
+func checkFleetResults(results []fleetResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("failed on %d of %d devices", failed, len(results))
+	}
+	return nil
+}
+
+func printFleetSummaryTable(p *printer, results []fleetResult) error {
+	p.wL.Lock()
+	defer p.wL.Unlock()
+
+	const (
+		minWidth = 0
+		tabWidth = 8
+		padding  = 2
+	)
+	w := tabwriter.NewWriter(p.w, minWidth, tabWidth, padding, ' ', 0)
+	fmt.Fprintln(w, "\nDEVICE\tAPI\tRESULT")
+	for _, result := range results {
+		outcome := "ok"
+		if result.Error != "" {
+			outcome = "failed: " + result.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Device, result.API, outcome)
+	}
+	return w.Flush()
+}
+
+// fleet status
+
+// fleetStatusReport is the machine-readable representation of snapshots of the states of every
+// device of a fleet.
+type fleetStatusReport struct {
+	Devices []deviceStatus `json:"devices"`
+}
+
+type deviceStatus struct {
+	fleetResult
+	Status *statusReport `json:"status,omitempty"`
+}
+
+func fleetStatusAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	devices, err := getFleetDevices(c)
+	if err != nil {
+		return err
+	}
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	// Unlike the dev status subcommand, we must also limit the time spent connecting, so that
+	// unreachable devices don't block the status of the rest of the fleet
+	ctxWait, cancelWait := context.WithTimeout(ctxRun, c.Duration("timeout"))
+	reportsL := &sync.Mutex{}
+	reports := make(map[string]*statusReport)
+	results := runFleet(ctxWait, c, p, devices, func(
+		ctx context.Context, device deviceProfile, client *planktoscope.Client,
+	) error {
+		state := awaitState(ctx, client)
+		reportsL.Lock()
+		defer reportsL.Unlock()
+
+		reports[device.Name] = &statusReport{
+			Time:    time.Now(),
+			API:     client.Config.URL,
+			Unknown: unknownSubsystems(state),
+			State:   state,
+		}
+		return nil
+	})
+	cancelWait()
+	cancelRun()
+
+	if p.format != textOutput {
+		statuses := make([]deviceStatus, 0, len(results))
+		for _, result := range results {
+			statuses = append(statuses, deviceStatus{
+				fleetResult: result,
+				Status:      reports[result.Device],
+			})
+		}
+		if err := p.printValue(fleetStatusReport{Devices: statuses}); err != nil {
+			return errors.Wrap(err, "couldn't print status")
+		}
+		return checkFleetResults(results)
+	}
+	for i, result := range results {
+		report, ok := reports[result.Device]
+		if !ok {
+			continue
+		}
+		if i > 0 {
+			if _, err := fmt.Fprintln(p.w); err != nil {
+				return errors.Wrap(err, "couldn't print status")
+			}
+		}
+		if err := printStatus(p.forDevice(result.Device), report.API, report.State); err != nil {
+			return errors.Wrap(err, "couldn't print status")
+		}
+	}
+	return printFleetSummary(p, results)
+}
+
+// fleet listen
+
+func fleetListenAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	devices, err := getFleetDevices(c)
+	if err != nil {
+		return err
+	}
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	results := runFleet(ctxRun, c, p, devices, func(
+		ctx context.Context, device deviceProfile, client *planktoscope.Client,
+	) error {
+		return listenAll(ctx, client, p.forDevice(device.Name))
+	})
+	cancelRun()
+
+	return printFleetSummary(p, results)
+}
+
+// fleet proc start
+
+func fleetProcStartAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	devices, err := getFleetDevices(c)
+	if err != nil {
+		return err
+	}
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	results := runFleet(ctxRun, c, p, devices, func(
+		ctx context.Context, device deviceProfile, client *planktoscope.Client,
+	) error {
+		return errors.Wrap(
+			startProc(ctx, c, client, client.Logger), "couldn't start data processing routine",
+		)
+	})
+	cancelRun()
+
+	return printFleetSummary(p, results)
+}
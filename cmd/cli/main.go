@@ -1,11 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	glog "github.com/labstack/gommon/log"
 	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+	"github.com/PlanktoScope/cli/pkg/discovery"
+	"github.com/PlanktoScope/cli/pkg/simulator"
 )
 
 func main() {
@@ -22,6 +28,9 @@ var app = &cli.App{
 	Usage:   "Command-line tool to operate and manage PlanktoScopes",
 	Commands: []*cli.Command{
 		devCmd,
+		simCmd,
+		discoverCmd,
+		fleetCmd,
 	},
 	Flags: []cli.Flag{
 		&cli.Uint64Flag{
@@ -30,17 +39,100 @@ var app = &cli.App{
 			Usage:   "Log level (1=debug, 2=info, 3=warn, 4=error, 5=off)",
 			EnvVars: []string{"PLANKTOSCOPE_LOG_LEVEL"},
 		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   textOutput,
+			Usage: fmt.Sprintf(
+				"Format of printed output (%s, %s, or %s)", textOutput, jsonOutput, ndjsonOutput,
+			),
+			EnvVars: []string{"PLANKTOSCOPE_OUTPUT"},
+		},
+		&cli.PathFlag{
+			Name: "config",
+			Usage: "Path of the configuration file (default: planktoscope/config.hcl in the user's " +
+				"configuration directory)",
+			EnvVars: []string{"PLANKTOSCOPE_CONFIG"},
+		},
 	},
 	Suggest: true,
 }
 
+// mqtt
+
+var mqttFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "mqtt-username",
+		Usage:   "Username for authentication to the MQTT broker",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_USERNAME"},
+	},
+	&cli.StringFlag{
+		Name:    "mqtt-password",
+		Usage:   "Password for authentication to the MQTT broker",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_PASSWORD"},
+	},
+	&cli.PathFlag{
+		Name: "mqtt-credentials-file",
+		Usage: "Path of an HCL file setting the username and password for authentication to the " +
+			"MQTT broker, if they aren't set by other flags",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_CREDENTIALS_FILE"},
+	},
+	&cli.PathFlag{
+		Name: "mqtt-ca-file",
+		Usage: "Path of a PEM-encoded bundle of CA certificates to trust for TLS connections to the " +
+			"MQTT broker",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_CA_FILE"},
+	},
+	&cli.PathFlag{
+		Name:    "mqtt-cert-file",
+		Usage:   "Path of a PEM-encoded client certificate for TLS connections to the MQTT broker",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_CERT_FILE"},
+	},
+	&cli.PathFlag{
+		Name:    "mqtt-key-file",
+		Usage:   "Path of the PEM-encoded private key of the client certificate",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_KEY_FILE"},
+	},
+	&cli.BoolFlag{
+		Name:    "mqtt-insecure-skip-verify",
+		Usage:   "Skip verification of the MQTT broker's TLS certificate",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_INSECURE_SKIP_VERIFY"},
+	},
+	&cli.Uint64Flag{
+		Name:    "mqtt-connect-timeout",
+		Value:   uint64(planktoscope.DefaultMQTTSettings().ConnectTimeout.Seconds()),
+		Usage:   "Timeout (in seconds) for each attempt to connect to the MQTT broker",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_CONNECT"},
+	},
+	&cli.Uint64Flag{
+		Name:    "mqtt-connect-retry-interval",
+		Value:   uint64(planktoscope.DefaultMQTTSettings().ConnectRetryInterval.Seconds()),
+		Usage:   "Interval (in seconds) between attempts to connect to the MQTT broker",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_CONNECT_RETRY"},
+	},
+	&cli.Uint64Flag{
+		Name:    "mqtt-reconnect-interval",
+		Value:   uint64(planktoscope.DefaultMQTTSettings().ReconnectInterval.Seconds()),
+		Usage:   "Maximum interval (in seconds) between attempts to reconnect to the MQTT broker",
+		EnvVars: []string{"PLANKTOSCOPE_MQTT_RECONNECT"},
+	},
+}
+
+// dry run
+
+var dryRunFlag = &cli.BoolFlag{
+	Name: "dry-run",
+	Usage: "Print the commands which would be sent over the API (with their MQTT topics, QoS " +
+		"levels, and payloads) instead of connecting to the API and sending them",
+}
+
 // dev
 
 var devCmd = &cli.Command{
 	Name:    "dev",
 	Aliases: []string{"device"},
 	Usage:   "Interfaces with an individual PlanktoScope device",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:    "api",
 			Value:   defaultAPIURL,
@@ -54,20 +146,246 @@ var devCmd = &cli.Command{
 			Usage:   "MQTT client instance ID of the API client",
 			EnvVars: []string{"PLANKTOSCOPE_CLIENT_INSTANCE_ID"},
 		},
-	},
+		&cli.StringFlag{
+			Name: "device",
+			Usage: "Name of a device profile in the configuration file to take settings from, " +
+				"unless they're overridden by other flags",
+			EnvVars: []string{"PLANKTOSCOPE_DEVICE"},
+		},
+	}, mqttFlags...),
 	Subcommands: []*cli.Command{
 		{
 			Name:   "listen",
 			Usage:  "Listens to and prints all messages exchanged over the API",
 			Action: devListenAction,
 		},
+		{
+			Name:   "status",
+			Usage:  "Prints a snapshot of the current state of the PlanktoScope device",
+			Action: devStatusAction,
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Value: defaultStatusTimeout,
+					Usage: "Maximum time to wait for the state of every subsystem to become known",
+				},
+			},
+		},
+		{
+			Name:   "record",
+			Usage:  "Records all messages exchanged over the API to a newline-delimited JSON file",
+			Action: devRecordAction,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "out",
+					Value: "session.ndjson",
+					Usage: "Path of the file to record messages to",
+				},
+				&cli.Uint64Flag{
+					Name:  "max-size",
+					Value: 0,
+					Usage: "Maximum size (in MB) of the file before it's rotated (0 disables size-based " +
+						"rotation)",
+				},
+				&cli.DurationFlag{
+					Name:  "max-age",
+					Value: 0,
+					Usage: "Maximum age of the file before it's rotated (0 disables time-based rotation)",
+				},
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "Replays messages recorded by the record subcommand, without connecting to the API",
+			ArgsUsage: "recording-file",
+			Action:    devReplayAction,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "speed",
+					Value: "1x",
+					Usage: "Speed at which to replay messages relative to the recorded timing, e.g. 10x " +
+						"(max replays messages without any delays)",
+				},
+			},
+		},
+		{
+			Name:      "run",
+			Usage:     "Runs a routine of steps declared in an HCL file, stopping at the first failed step",
+			ArgsUsage: "routine-file",
+			Action:    devRunAction,
+			Flags: []cli.Flag{
+				dryRunFlag,
+				&cli.StringSliceFlag{
+					Name: "var",
+					Usage: "Value of a variable declared in the routine file, as name=value; can be " +
+						"specified multiple times",
+				},
+			},
+		},
+		{
+			Name:      "pub",
+			Aliases:   []string{"publish"},
+			Usage:     "Publishes a raw JSON message to an arbitrary topic of the MQTT API",
+			ArgsUsage: "topic json-payload",
+			Action:    devPubAction,
+			Flags: []cli.Flag{
+				dryRunFlag,
+				&cli.Uint64Flag{
+					Name:  "qos",
+					Value: 1,
+					Usage: "QoS level of the message (0, 1, or 2)",
+				},
+				&cli.BoolFlag{
+					Name:  "retain",
+					Usage: "Ask the MQTT broker to retain the message for future subscribers",
+				},
+			},
+		},
+		{
+			Name:      "sub",
+			Aliases:   []string{"subscribe"},
+			Usage:     "Prints the raw messages on topics of the MQTT API matching a topic filter",
+			ArgsUsage: "topic-filter",
+			Action:    devSubAction,
+		},
 		devHALCmd,
 		devCtlCmd,
 		devProcCmd,
 	},
 }
 
-const defaultAPIURL = "mqtt://home.planktoscope:1883"
+// fleet
+
+var fleetCmd = &cli.Command{
+	Name:  "fleet",
+	Usage: "Interfaces with multiple PlanktoScope devices at once",
+	Flags: append([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "device",
+			Aliases: []string{"d"},
+			Usage: "Name of a device profile in the configuration file, or the API URL of a " +
+				"device; can be specified multiple times",
+			EnvVars: []string{"PLANKTOSCOPE_FLEET_DEVICES"},
+		},
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "Include every device profile in the configuration file",
+		},
+	}, mqttFlags...),
+	Subcommands: []*cli.Command{
+		{
+			Name:   "listen",
+			Usage:  "Listens to and prints all messages exchanged over the APIs of the devices",
+			Action: fleetListenAction,
+		},
+		{
+			Name:   "status",
+			Usage:  "Prints a snapshot of the current state of each device",
+			Action: fleetStatusAction,
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Value: defaultStatusTimeout,
+					Usage: "Maximum time to wait to connect to each device and for the state of every " +
+						"subsystem to become known",
+				},
+			},
+		},
+		{
+			Name:    "proc",
+			Aliases: []string{"processing"},
+			Usage:   "Interfaces with the data processing APIs of the devices",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "start",
+					Usage:  "Begins a data processing routine on each device",
+					Action: fleetProcStartAction,
+					Flags:  procStartFlags,
+				},
+			},
+		},
+	},
+}
+
+// discover
+
+var discoverCmd = &cli.Command{
+	Name:   "discover",
+	Usage:  "Finds PlanktoScopes on the local network with mDNS/DNS-SD",
+	Action: discoverAction,
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Value: defaultDiscoverTimeout,
+			Usage: "Time to wait for responses from PlanktoScopes on the local network",
+		},
+		&cli.StringFlag{
+			Name:  "prefix",
+			Value: discovery.DefaultOptions().HostPrefix,
+			Usage: "Prefix of the hostnames of PlanktoScopes (an empty prefix matches every host)",
+		},
+		&cli.Uint64Flag{
+			Name:  "port",
+			Value: uint64(discovery.DefaultOptions().MQTTPort),
+			Usage: "Port to probe for the MQTT API of each PlanktoScope",
+		},
+		&cli.BoolFlag{
+			Name: "save",
+			Usage: "Save each PlanktoScope with a reachable API as a device profile in the " +
+				"configuration file, named by its hostname",
+		},
+	},
+}
+
+// sim
+
+var simCmd = &cli.Command{
+	Name:  "sim",
+	Usage: "Simulates a PlanktoScope device for testing and demonstrations without hardware",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "run",
+			Usage:  "Runs a simulated PlanktoScope device on an existing MQTT broker",
+			Action: simRunAction,
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:    "api",
+					Value:   defaultAPIURL,
+					Usage:   "Path of the MQTT broker to serve the simulated PlanktoScope's API on",
+					EnvVars: []string{"PLANKTOSCOPE_API"},
+				},
+				&cli.Float64Flag{
+					Name:  "speed",
+					Value: simulator.DefaultConfig().Speed,
+					Usage: "Rate at which simulated operations run relative to a real PlanktoScope",
+				},
+			}, mqttFlags...),
+		},
+		{
+			Name:   "serve",
+			Usage:  "Runs a simulated PlanktoScope device on an embedded MQTT broker",
+			Action: simServeAction,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "listen",
+					Value: ":1883",
+					Usage: "Address for the embedded MQTT broker to listen on",
+				},
+				&cli.Float64Flag{
+					Name:  "speed",
+					Value: simulator.DefaultConfig().Speed,
+					Usage: "Rate at which simulated operations run relative to a real PlanktoScope",
+				},
+			},
+		},
+	},
+}
+
+const (
+	defaultAPIURL          = "mqtt://home.planktoscope:1883"
+	defaultStatusTimeout   = 3 * time.Second
+	defaultDiscoverTimeout = 3 * time.Second
+)
 
 var devHALCmd = &cli.Command{
 	Name:    "hal",
@@ -79,6 +397,58 @@ var devHALCmd = &cli.Command{
 			Usage:  "Listens to and prints all messages exchanged over the API",
 			Action: devHALListenAction,
 		},
+		devHALPumpCmd,
+		devHALCameraCmd,
+	},
+}
+
+var devHALPumpCmd = &cli.Command{
+	Name:  "pump",
+	Usage: "Operates the PlanktoScope device's pump",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "start",
+			Usage:  "Starts pumping a volume of liquid through the PlanktoScope device",
+			Action: devHALPumpStartAction,
+			Flags: []cli.Flag{
+				dryRunFlag,
+				&cli.StringFlag{
+					Name:  "direction",
+					Value: forwardDirection,
+					Usage: fmt.Sprintf(
+						"Direction of the pump (%s or %s)", forwardDirection, backwardDirection,
+					),
+				},
+				&cli.Float64Flag{
+					Name:  "volume",
+					Value: planktoscope.DefaultPumpSettings().Volume,
+					Usage: "Volume of liquid to pump (mL)",
+				},
+				&cli.Float64Flag{
+					Name:  "flowrate",
+					Value: planktoscope.DefaultPumpSettings().Flowrate,
+					Usage: "Flow rate at which to pump the liquid (mL/min)",
+				},
+				&cli.BoolFlag{
+					Name:  "await-started",
+					Value: true,
+					Usage: "Whether to wait for confirmation from the hardware abstraction layer API that " +
+						"the pump has started before exiting",
+				},
+				&cli.BoolFlag{
+					Name:  "await-finished",
+					Value: true,
+					Usage: "Whether to wait for confirmation from the hardware abstraction layer API that " +
+						"the pump has finished before exiting",
+				},
+			},
+		},
+		{
+			Name:   "stop",
+			Usage:  "Stops the PlanktoScope device's pump",
+			Action: devHALPumpStopAction,
+			Flags:  []cli.Flag{dryRunFlag},
+		},
 	},
 }
 
@@ -92,6 +462,76 @@ var devCtlCmd = &cli.Command{
 			Usage:  "Listens to and prints all messages exchanged over the API",
 			Action: devCtlListenAction,
 		},
+		devCtlImageCmd,
+	},
+}
+
+var devCtlImageCmd = &cli.Command{
+	Name:    "image",
+	Aliases: []string{"imaging"},
+	Usage:   "Operates the PlanktoScope device's image acquisition routine",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "start",
+			Usage:  "Begins an image acquisition routine on the PlanktoScope device",
+			Action: devCtlImageStartAction,
+			Flags: []cli.Flag{
+				dryRunFlag,
+				&cli.StringFlag{
+					Name:     "sample-project-id",
+					Aliases:  []string{"project"},
+					Usage:    "Name of the project which the sample belongs to",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "sample-id",
+					Aliases:  []string{"sample"},
+					Usage:    "Name of the sample to acquire images of",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "direction",
+					Value: forwardDirection,
+					Usage: fmt.Sprintf(
+						"Direction of the pump between frames (%s or %s)", forwardDirection, backwardDirection,
+					),
+				},
+				&cli.Float64Flag{
+					Name:  "step-volume",
+					Value: planktoscope.DefaultImagerSettings().StepVolume,
+					Usage: "Volume of liquid to pump between frames (mL)",
+				},
+				&cli.Float64Flag{
+					Name:  "step-delay",
+					Value: planktoscope.DefaultImagerSettings().StepDelay,
+					Usage: "Time to wait for the liquid to stabilize after pumping, before each frame (s)",
+				},
+				&cli.Uint64Flag{
+					Name:    "steps",
+					Aliases: []string{"frames"},
+					Value:   planktoscope.DefaultImagerSettings().Steps,
+					Usage:   "Number of frames to acquire",
+				},
+				&cli.BoolFlag{
+					Name:  "await-started",
+					Value: true,
+					Usage: "Whether to wait for confirmation from the controller API that the image " +
+						"acquisition routine has started before exiting",
+				},
+				&cli.BoolFlag{
+					Name:  "await-finished",
+					Value: true,
+					Usage: "Whether to wait for confirmation from the controller API that the image " +
+						"acquisition routine has finished before exiting",
+				},
+			},
+		},
+		{
+			Name:   "stop",
+			Usage:  "Stops the image acquisition routine on the PlanktoScope device",
+			Action: devCtlImageStopAction,
+			Flags:  []cli.Flag{dryRunFlag},
+		},
 	},
 }
 
@@ -109,50 +549,122 @@ var devProcCmd = &cli.Command{
 			Name:   "start",
 			Usage:  "Begins a data processing routine on the PlanktoScope device",
 			Action: devProcStartAction,
+			Flags:  procStartFlags,
+		},
+		{
+			Name:   "stop",
+			Usage:  "Stops the data processing routine on the PlanktoScope device",
+			Action: devProcStopAction,
+			Flags:  []cli.Flag{dryRunFlag},
+		},
+	},
+}
+
+var procStartFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "path",
+		Value: "/home/pi/data/img",
+		Usage: "Root directory on the PlanktoScope device of raw datasets to process",
+	},
+	&cli.Uint64Flag{
+		Name:  "processing-id",
+		Value: 1,
+		Usage: "Unique ID of the data processing routine",
+	},
+	&cli.BoolFlag{
+		Name:  "recurse",
+		Value: true,
+		Usage: "Whether to recurse into all child directories of the root directory when " +
+			"identifying datasets to process",
+	},
+	&cli.BoolFlag{
+		Name:  "force-reprocessing",
+		Value: false,
+		Usage: "Whether to run the processing routine on datasets for which processing results " +
+			"already exist",
+	},
+	&cli.BoolFlag{
+		Name:  "keep-objects",
+		Value: true,
+		Usage: "Whether to keep individual images of isolated objects in the processing results",
+	},
+	&cli.BoolFlag{
+		Name:  "export-ecotaxa",
+		Value: true,
+		Usage: "Whether to export the processing results as an archive for upload to EcoTaxa",
+	},
+	&cli.BoolFlag{
+		Name:  "await-started",
+		Value: true,
+		Usage: "Whether to wait for confirmation from the data processing API that the " +
+			"processing routine has started before exiting",
+	},
+	&cli.BoolFlag{
+		Name:  "await-finished",
+		Value: true,
+		Usage: "Whether to wait for confirmation from the data processing API that the " +
+			"processing routine has finished before exiting",
+	},
+	&cli.BoolFlag{
+		Name:  "stop-on-interrupt",
+		Value: false,
+		Usage: "Whether to stop the processing routine if this command is interrupted while " +
+			"waiting for the processing routine to start or finish",
+	},
+	dryRunFlag,
+}
+
+var devHALCameraCmd = &cli.Command{
+	Name:  "camera",
+	Usage: "Operates the PlanktoScope device's camera",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "get",
+			Usage:  "Waits for and prints the camera settings of the PlanktoScope device",
+			Action: devHALCameraGetAction,
 			Flags: []cli.Flag{
-				&cli.StringFlag{
-					Name:  "path",
-					Value: "/home/pi/data/img",
-					Usage: "Root directory on the PlanktoScope device of raw datasets to process",
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Value: 0,
+					Usage: "Maximum time to wait for the camera settings to become known (0 waits forever)",
 				},
+			},
+		},
+		{
+			Name:   "set",
+			Usage:  "Changes the camera settings of the PlanktoScope device",
+			Action: devHALCameraSetAction,
+			Flags: []cli.Flag{
+				dryRunFlag,
 				&cli.Uint64Flag{
-					Name:  "processing-id",
-					Value: 1,
-					Usage: "Unique ID of the data processing routine",
-				},
-				&cli.BoolFlag{
-					Name:  "recurse",
-					Value: true,
-					Usage: "Whether to recurse into all child directories of the root directory when " +
-						"identifying datasets to process",
-				},
-				&cli.BoolFlag{
-					Name:  "force-reprocessing",
-					Value: false,
-					Usage: "Whether to run the processing routine on datasets for which processing results " +
-						"already exist",
+					Name:  "iso",
+					Value: planktoscope.DefaultCameraSettings().ISO,
+					Usage: fmt.Sprintf("ISO of the camera (one of %v)", planktoscope.CameraISOs),
 				},
-				&cli.BoolFlag{
-					Name:  "keep-objects",
-					Value: true,
-					Usage: "Whether to keep individual images of isolated objects in the processing results",
+				&cli.Uint64Flag{
+					Name:  "shutter-speed",
+					Value: planktoscope.DefaultCameraSettings().ShutterSpeed,
+					Usage: fmt.Sprintf(
+						"Shutter speed of the camera in microseconds (one of %v)",
+						planktoscope.CameraShutterSpeeds,
+					),
 				},
-				&cli.BoolFlag{
-					Name:  "export-ecotaxa",
-					Value: true,
-					Usage: "Whether to export the processing results as an archive for upload to EcoTaxa",
+				&cli.StringFlag{
+					Name:  "white-balance",
+					Value: autoWhiteBalance,
+					Usage: fmt.Sprintf(
+						"White balance mode of the camera (%s or %s)", autoWhiteBalance, manualWhiteBalance,
+					),
 				},
-				&cli.BoolFlag{
-					Name:  "await-started",
-					Value: true,
-					Usage: "Whether to wait for confirmation from the data processing API that the " +
-						"processing routine has started before exiting",
+				&cli.Float64Flag{
+					Name:  "red-gain",
+					Value: planktoscope.DefaultCameraSettings().WhiteBalanceRedGain,
+					Usage: "Red gain of the camera's white balance, used only in manual white balance mode",
 				},
-				&cli.BoolFlag{
-					Name:  "await-finished",
-					Value: true,
-					Usage: "Whether to wait for confirmation from the data processing API that the " +
-						"processing routine has finished before exiting",
+				&cli.Float64Flag{
+					Name:  "blue-gain",
+					Value: planktoscope.DefaultCameraSettings().WhiteBalanceBlueGain,
+					Usage: "Blue gain of the camera's white balance, used only in manual white balance mode",
 				},
 			},
 		},
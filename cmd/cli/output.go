@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+const (
+	textOutput   = "text"
+	jsonOutput   = "json"
+	ndjsonOutput = "ndjson"
+)
+
+// stateUpdate is the machine-readable representation of a change to the state of a subsystem of
+// a PlanktoScope.
+type stateUpdate struct {
+	Time      time.Time   `json:"time"`
+	Device    string      `json:"device,omitempty"`
+	Subsystem string      `json:"subsystem"`
+	Event     string      `json:"event,omitempty"`
+	State     interface{} `json:"state"`
+}
+
+// command is the machine-readable representation of a command which would be sent to a
+// PlanktoScope in a dry run.
+type command struct {
+	Device   string          `json:"device,omitempty"`
+	Topic    string          `json:"topic"`
+	QoS      byte            `json:"qos"`
+	Retained bool            `json:"retained"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// message is the machine-readable representation of a raw message received over the MQTT API.
+type message struct {
+	Received time.Time       `json:"received"`
+	Device   string          `json:"device,omitempty"`
+	Topic    string          `json:"topic"`
+	QoS      byte            `json:"qos"`
+	Retained bool            `json:"retained"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+const (
+	pumpSubsystem       = "pump"
+	cameraSubsystem     = "camera"
+	imagerSubsystem     = "imager"
+	segmenterSubsystem  = "segmenter"
+	connectionSubsystem = "connection"
+)
+
+// printer prints state updates to an output stream in the output format selected by the user.
+type printer struct {
+	format string
+	w      io.Writer
+	wL     *sync.Mutex
+	// device is the name of the device whose state updates are printed, if the output includes
+	// state updates from multiple devices.
+	device string
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+	switch format {
+	default:
+		return nil, errors.Errorf(
+			"unknown output format %s (must be %s, %s, or %s)",
+			format, textOutput, jsonOutput, ndjsonOutput,
+		)
+	case textOutput, jsonOutput, ndjsonOutput:
+		return &printer{
+			format: format,
+			w:      w,
+			wL:     &sync.Mutex{},
+		}, nil
+	}
+}
+
+func makePrinter(c *cli.Context) (*printer, error) {
+	return newPrinter(c.String("output"), os.Stdout)
+}
+
+// forDevice makes a printer which shares the output stream, for printing the state updates of a
+// device. In text output, every line is prefixed with the name of the device.
+func (p *printer) forDevice(name string) *printer {
+	w := p.w
+	if p.format == textOutput {
+		w = &prefixWriter{w: p.w, prefix: []byte(name + ": ")}
+	}
+	return &printer{
+		format: p.format,
+		w:      w,
+		wL:     p.wL,
+		device: name,
+	}
+}
+
+func (p *printer) printValue(value interface{}) (err error) {
+	p.wL.Lock()
+	defer p.wL.Unlock()
+
+	switch p.format {
+	default:
+		_, err = fmt.Fprintf(p.w, "%+v\n", value)
+		return err
+	case jsonOutput:
+		encoder := json.NewEncoder(p.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case ndjsonOutput:
+		return json.NewEncoder(p.w).Encode(value)
+	}
+}
+
+func (p *printer) printState(subsystem string, state interface{}) error {
+	return p.printStateUpdate(stateUpdate{
+		Time:      time.Now(),
+		Subsystem: subsystem,
+		State:     state,
+	})
+}
+
+func (p *printer) printEvent(e planktoscope.Event) error {
+	return p.printStateUpdate(stateUpdate{
+		Time:      e.Received,
+		Subsystem: e.Type.Subsystem(),
+		Event:     string(e.Type),
+		State:     e.Payload,
+	})
+}
+
+func (p *printer) printStateUpdate(update stateUpdate) error {
+	update.Device = p.device
+	if p.format == textOutput {
+		return p.printValue(update.State)
+	}
+	return p.printValue(update)
+}
+
+// printCommand prints a command which would be sent to a PlanktoScope in a dry run.
+func (p *printer) printCommand(m planktoscope.RawMessage) error {
+	if p.format == textOutput {
+		return p.printValue(formatRawMessage(m))
+	}
+	payload, err := jsonPayload(m.Payload)
+	if err != nil {
+		return err
+	}
+	return p.printValue(command{
+		Device:   p.device,
+		Topic:    m.Topic,
+		QoS:      m.QoS,
+		Retained: m.Retained,
+		Payload:  payload,
+	})
+}
+
+// printMessage prints a raw message received over the MQTT API.
+func (p *printer) printMessage(m planktoscope.RawMessage) error {
+	if p.format == textOutput {
+		return p.printValue(formatRawMessage(m))
+	}
+	payload, err := jsonPayload(m.Payload)
+	if err != nil {
+		return err
+	}
+	return p.printValue(message{
+		Received: m.Received,
+		Device:   p.device,
+		Topic:    m.Topic,
+		QoS:      m.QoS,
+		Retained: m.Retained,
+		Payload:  payload,
+	})
+}
+
+func formatRawMessage(m planktoscope.RawMessage) string {
+	retained := ""
+	if m.Retained {
+		retained = ", retained"
+	}
+	return fmt.Sprintf("%s (QoS %d%s): %s", m.Topic, m.QoS, retained, m.Payload)
+}
+
+// jsonPayload returns the payload as-is if it's valid JSON, or else encodes it as a JSON string,
+// so that payloads which aren't JSON don't produce invalid output.
+func jsonPayload(payload string) (json.RawMessage, error) {
+	if raw := json.RawMessage(payload); json.Valid(raw) {
+		return raw, nil
+	}
+	return json.Marshal(payload)
+}
+
+// prefixWriter writes a prefix at the start of every line written to it.
+type prefixWriter struct {
+	w       io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+func (w *prefixWriter) Write(b []byte) (written int, err error) {
+	for len(b) > 0 {
+		if !w.midLine {
+			if _, err = w.w.Write(w.prefix); err != nil {
+				return written, err
+			}
+			w.midLine = true
+		}
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+			w.midLine = false
+		}
+		n, err := w.w.Write(line)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(line):]
+	}
+	return written, nil
+}
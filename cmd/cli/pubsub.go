@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+// maxQoS is the highest QoS level supported by MQTT.
+const maxQoS = 2
+
+// pub
+
+func devPubAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.New("expected a topic and a JSON payload")
+	}
+	topic, payload := c.Args().Get(0), c.Args().Get(1)
+	if err := planktoscope.ValidateTopic(topic); err != nil {
+		return errors.Wrap(err, "invalid topic")
+	}
+	if !json.Valid([]byte(payload)) {
+		return errors.Errorf("payload %s isn't valid JSON", payload)
+	}
+	qos := c.Uint64("qos")
+	if qos > maxQoS {
+		return errors.Errorf("unsupported QoS level %d (must be 0, 1, or 2)", qos)
+	}
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("publishing to %s...", topic)
+	err = publish(client, topic, byte(qos), c.Bool("retain"), []byte(payload))
+	closeClient(client, logger)
+	return errors.Wrapf(err, "couldn't publish to %s", topic)
+}
+
+func publish(
+	client *planktoscope.Client, topic string, qos byte, retained bool, payload []byte,
+) error {
+	token := client.Transport.Publish(topic, qos, retained, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// sub
+
+func devSubAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("expected a topic filter")
+	}
+	filter := c.Args().First()
+	if err := planktoscope.ValidateTopicFilter(filter); err != nil {
+		return errors.Wrap(err, "invalid topic filter")
+	}
+	if strings.HasPrefix(filter, "$") {
+		// The client only subscribes to #, which doesn't match topics reserved by the broker
+		return errors.Errorf(
+			"topic filter %s for topics reserved by the broker isn't supported", filter,
+		)
+	}
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	// Messages on topics which the client doesn't handle would otherwise be logged, duplicating the
+	// printed messages
+	client, logger, err := makeClient(c, planktoscope.WithoutUnhandledMessageLogs())
+	if err != nil {
+		return err
+	}
+	// The handler must be added before the client connects, so that we don't miss any retained
+	// messages delivered upon connection
+	client.AddMessageHandler(func(m planktoscope.RawMessage) {
+		if !planktoscope.MatchTopic(filter, m.Topic) {
+			return
+		}
+		if err := p.printMessage(m); err != nil {
+			logger.Error(errors.Wrapf(err, "couldn't print message on %s", m.Topic))
+		}
+	})
+	if err = connectClient(client, logger); err != nil {
+		return err
+	}
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	<-ctxRun.Done()
+	cancelRun()
+
+	closeClient(client, logger)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+func devRecordAction(c *cli.Context) error {
+	const megabyte = 1000 * 1000 // bytes
+	path := c.String("out")
+	recorder, err := planktoscope.NewRecorder(
+		path, int64(c.Uint64("max-size")*megabyte), c.Duration("max-age"),
+	)
+	if err != nil {
+		return errors.Wrap(err, "couldn't start recording")
+	}
+
+	client, logger, err := makeClient(c)
+	if err != nil {
+		_ = recorder.Close()
+		return err
+	}
+	// The handler must be added before the client connects, so that we don't miss any retained
+	// messages delivered upon connection
+	client.AddMessageHandler(func(m planktoscope.RawMessage) {
+		if err := recorder.Record(m); err != nil {
+			logger.Error(errors.Wrapf(err, "couldn't record message on %s", m.Topic))
+		}
+	})
+	if err = connectClient(client, logger); err != nil {
+		_ = recorder.Close()
+		return err
+	}
+
+	logger.Infof("Recording messages to %s...", path)
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	<-ctxRun.Done()
+	cancelRun()
+
+	closeClient(client, logger)
+	return errors.Wrapf(recorder.Close(), "couldn't close recording file %s", path)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+const maxSpeed = "max"
+
+// parseSpeed parses a replay speed like "10x" or "0.5"; a speed of zero means that messages should
+// be replayed without delays.
+func parseSpeed(speed string) (float64, error) {
+	if speed == maxSpeed {
+		return 0, nil
+	}
+	const floatWidth = 64
+	parsed, err := strconv.ParseFloat(strings.TrimSuffix(speed, "x"), floatWidth)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't parse speed %s", speed)
+	}
+	if parsed <= 0 {
+		return 0, errors.Errorf("speed %s must be positive", speed)
+	}
+	return parsed, nil
+}
+
+func makeReplayClient(c *cli.Context, path string) (*planktoscope.Client, error) {
+	clientID := makeClientID(c.String("instance-id"))
+	// The client never connects to the API, so we only use the recording's path to label it; its
+	// config must not be made from the MQTT settings in environment variables, which may be
+	// invalid for that path (e.g. TLS settings for a URL without TLS)
+	config := planktoscope.Config{URL: "file://" + path, ClientID: clientID}
+	logger := makeLogger(c, clientID)
+	client, err := planktoscope.NewClient(config, logger)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't make client for %s", path)
+	}
+	return client, nil
+}
+
+func devReplayAction(c *cli.Context) error {
+	path := c.Args().First()
+	if path == "" {
+		return errors.New("missing path of recording file")
+	}
+	speed, err := parseSpeed(c.String("speed"))
+	if err != nil {
+		return err
+	}
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	client, err := makeReplayClient(c, path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open recording file %s", path)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	defer cancelRun()
+	ctxEvents, cancelEvents := context.WithCancel(ctxRun)
+	defer cancelEvents()
+	events := client.Subscribe(ctxEvents)
+	return replay(ctxRun, planktoscope.NewRecordingReader(file), speed, client, events, p)
+}
+
+func replay(
+	ctx context.Context, r *planktoscope.RecordingReader, speed float64,
+	client *planktoscope.Client, events <-chan planktoscope.Event, p *printer,
+) error {
+	var prevReceived time.Time
+	for {
+		m, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if speed > 0 && !prevReceived.IsZero() {
+			delay := time.Duration(float64(m.Received.Sub(prevReceived)) / speed)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+		}
+		prevReceived = m.Received
+		client.Replay(m)
+
+		// Replay completes all resulting events before returning, so we can print them all now
+		if err := printPendingEvents(events, p); err != nil {
+			return err
+		}
+	}
+}
+
+func printPendingEvents(events <-chan planktoscope.Event, p *printer) error {
+	for {
+		select {
+		default:
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := p.printEvent(e); err != nil {
+				return errors.Wrap(err, "couldn't print event")
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/PlanktoScope/cli/pkg/routines"
+)
+
+func devRunAction(c *cli.Context) error {
+	path := c.Args().First()
+	if path == "" {
+		return errors.New("missing path of routine file")
+	}
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	// We validate the whole routine before connecting, so that mistakes in the routine file are
+	// caught before any operation is started
+	vars, err := parseRoutineVars(c.StringSlice("var"))
+	if err != nil {
+		return err
+	}
+	routine, err := routines.ReadFile(path, vars)
+	if err != nil {
+		return err
+	}
+
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	var printErr error
+	err = routine.Run(ctxRun, client, func(report routines.StepReport) {
+		if err := printStepReport(p, report); err != nil && printErr == nil {
+			printErr = err
+		}
+	})
+	cancelRun()
+
+	closeClient(client, logger)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't run routine %s", path)
+	}
+	return errors.Wrap(printErr, "couldn't print step report")
+}
+
+// parseRoutineVars parses variable assignments like name=value into the values of the variables.
+func parseRoutineVars(assignments []string) (map[string]cty.Value, error) {
+	vars := make(map[string]cty.Value)
+	for _, assignment := range assignments {
+		name, raw, ok := strings.Cut(assignment, "=")
+		if !ok || name == "" {
+			return nil, errors.Errorf("invalid variable assignment %s (must be name=value)", assignment)
+		}
+		vars[name] = routines.ParseVariable(raw)
+	}
+	return vars, nil
+}
+
+func printStepReport(p *printer, report routines.StepReport) error {
+	if p.format != textOutput {
+		return p.printValue(report)
+	}
+	prefix := fmt.Sprintf("[%d/%d] %s", report.Index, report.Steps, report.Kind)
+	switch report.State {
+	default:
+		return p.printValue(fmt.Sprintf("%s: %s", prefix, report.State))
+	case routines.StepDone:
+		return p.printValue(fmt.Sprintf(
+			"%s: done in %s%s", prefix, report.Duration.Round(time.Millisecond),
+			formatStepResult(report.Result),
+		))
+	case routines.StepFailed:
+		return p.printValue(fmt.Sprintf(
+			"%s: failed after %s: %s", prefix, report.Duration.Round(time.Millisecond), report.Error,
+		))
+	}
+}
+
+func formatStepResult(result routines.Result) string {
+	if result.Frames == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d frames)", result.Frames)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/atrox/haikunatorgo"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+	"github.com/PlanktoScope/cli/pkg/simulator"
+)
+
+func makeSimulatorConfig(c *cli.Context) (simulator.Config, error) {
+	config := simulator.DefaultConfig()
+	if config.Speed = c.Float64("speed"); config.Speed <= 0 {
+		return simulator.Config{}, errors.Errorf("invalid speed %g (must be positive)", config.Speed)
+	}
+	return config, nil
+}
+
+func runSimulator(sim *simulator.Simulator, logger planktoscope.Logger) error {
+	if err := sim.Start(); err != nil {
+		return errors.Wrap(err, "couldn't start simulator")
+	}
+	logger.Info("Simulating a PlanktoScope...")
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	<-ctxRun.Done()
+	cancelRun()
+
+	logger.Info("Stopping simulator...")
+	sim.Shutdown()
+	return nil
+}
+
+// sim run
+
+func simRunAction(c *cli.Context) error {
+	config, err := makeSimulatorConfig(c)
+	if err != nil {
+		return err
+	}
+	apiURL := c.String("api")
+	clientID := fmt.Sprintf("planktoscope/sim/%s", haikunator.New().Haikunate())
+	settings, err := makeMQTTSettings(c, nil)
+	if err != nil {
+		return err
+	}
+	mqttConfig, err := planktoscope.NewMQTTConfig(apiURL, clientID, settings)
+	if err != nil {
+		return errors.Wrap(err, "couldn't make MQTT client config")
+	}
+	if mqttConfig == nil {
+		return errors.New("no MQTT broker specified")
+	}
+	logger := makeLogger(c, clientID)
+
+	logger.Infof("Connecting to %s", apiURL)
+	sim := simulator.New(config, logger, planktoscope.NewPahoTransport(*mqttConfig))
+	return errors.Wrapf(runSimulator(sim, logger), "couldn't simulate PlanktoScope on %s", apiURL)
+}
+
+// sim serve
+
+func simServeAction(c *cli.Context) error {
+	config, err := makeSimulatorConfig(c)
+	if err != nil {
+		return err
+	}
+	logger := makeLogger(c, "planktoscope/sim")
+
+	bus := simulator.NewBus()
+	broker := simulator.NewBroker(bus, logger)
+	address := c.String("listen")
+	if err = broker.Listen(address); err != nil {
+		return errors.Wrap(err, "couldn't start embedded MQTT broker")
+	}
+	logger.Infof("Serving MQTT broker on %s", broker.Addr())
+
+	sim := simulator.New(config, logger, bus.NewTransport())
+	if err = runSimulator(sim, logger); err != nil {
+		_ = broker.Close()
+		return err
+	}
+	return errors.Wrap(broker.Close(), "couldn't stop embedded MQTT broker")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+// statusReport is the machine-readable representation of a snapshot of the state of a
+// PlanktoScope.
+type statusReport struct {
+	Time    time.Time                 `json:"time"`
+	API     string                    `json:"api"`
+	Unknown []string                  `json:"unknown_subsystems"`
+	State   planktoscope.Planktoscope `json:"state"`
+}
+
+func unknownSubsystems(state planktoscope.Planktoscope) []string {
+	unknown := make([]string, 0)
+	if !state.Pump.StateKnown {
+		unknown = append(unknown, pumpSubsystem)
+	}
+	if !state.CameraSettings.StateKnown {
+		unknown = append(unknown, cameraSubsystem)
+	}
+	if !state.Imager.StateKnown {
+		unknown = append(unknown, imagerSubsystem)
+	}
+	if !state.Segmenter.StateKnown {
+		unknown = append(unknown, segmenterSubsystem)
+	}
+	return unknown
+}
+
+// awaitState waits until the state of every subsystem is known, or until the context is done,
+// and returns the latest state.
+func awaitState(ctx context.Context, client *planktoscope.Client) planktoscope.Planktoscope {
+	for {
+		pumpUpdated := client.PumpStateBroadcasted()
+		cameraUpdated := client.CameraStateBroadcasted()
+		imagerUpdated := client.ImagerStateBroadcasted()
+		segmenterUpdated := client.SegmenterStateBroadcasted()
+		state := client.GetState()
+		if len(unknownSubsystems(state)) == 0 {
+			return state
+		}
+		select {
+		case <-ctx.Done():
+			return state
+		case <-pumpUpdated:
+		case <-cameraUpdated:
+		case <-imagerUpdated:
+		case <-segmenterUpdated:
+		}
+	}
+}
+
+func devStatusAction(c *cli.Context) error {
+	p, err := makePrinter(c)
+	if err != nil {
+		return err
+	}
+	client, logger, err := makeConnectedClient(c)
+	if err != nil {
+		return err
+	}
+
+	ctxRun, cancelRun := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT,
+	)
+	ctxWait, cancelWait := context.WithTimeout(ctxRun, c.Duration("timeout"))
+	state := awaitState(ctxWait, client)
+	cancelWait()
+	cancelRun()
+
+	closeClient(client, logger)
+	return errors.Wrap(printStatus(p, client.Config.URL, state), "couldn't print status")
+}
+
+func printStatus(p *printer, api string, state planktoscope.Planktoscope) error {
+	if p.format != textOutput {
+		return p.printValue(statusReport{
+			Time:    time.Now(),
+			API:     api,
+			Unknown: unknownSubsystems(state),
+			State:   state,
+		})
+	}
+
+	p.wL.Lock()
+	defer p.wL.Unlock()
+
+	const (
+		minWidth = 0
+		tabWidth = 8
+		padding  = 2
+	)
+	w := tabwriter.NewWriter(p.w, minWidth, tabWidth, padding, ' ', 0)
+	fmt.Fprintf(w, "API:\t%s\n\n", api)
+	fmt.Fprintln(w, "SUBSYSTEM\tSTATUS\tDETAILS")
+	fmt.Fprintf(
+		w, "%s\t%s\t%s\n", pumpSubsystem, describePump(state.Pump),
+		describePumpSettings(state.PumpSettings),
+	)
+	fmt.Fprintf(
+		w, "%s\t%s\t%s\n", cameraSubsystem, describeKnown(state.CameraSettings.StateKnown),
+		describeCameraSettings(state.CameraSettings),
+	)
+	fmt.Fprintf(
+		w, "%s\t%s\t%s\n", imagerSubsystem, describeImager(state.Imager),
+		describeImagerSettings(state.Imager, state.ImagerSettings),
+	)
+	fmt.Fprintf(
+		w, "%s\t%s\t%s\n", segmenterSubsystem, describeSegmenter(state.Segmenter),
+		describeSegmenterSettings(state.Segmenter, state.SegmenterSettings),
+	)
+	return w.Flush()
+}
+
+const (
+	unknownStatus     = "unknown"
+	knownStatus       = "known"
+	idleStatus        = "idle"
+	interruptedStatus = "interrupted"
+)
+
+func describeKnown(known bool) string {
+	if !known {
+		return unknownStatus
+	}
+	return knownStatus
+}
+
+func describeActivity(known, active, interrupted bool, activeStatus string) string {
+	switch {
+	case !known:
+		return unknownStatus
+	case active:
+		return activeStatus
+	case interrupted:
+		return interruptedStatus
+	default:
+		return idleStatus
+	}
+}
+
+func describeDirection(forward bool) string {
+	if forward {
+		return forwardDirection
+	}
+	return backwardDirection
+}
+
+// Pump
+
+func describePump(s planktoscope.Pump) string {
+	return describeActivity(s.StateKnown, s.Pumping, s.Interrupted, "pumping")
+}
+
+func describePumpSettings(s planktoscope.PumpSettings) string {
+	return fmt.Sprintf(
+		"%s, %g mL at %g mL/min", describeDirection(s.Forward), s.Volume, s.Flowrate,
+	)
+}
+
+// Camera
+
+func describeCameraSettings(s planktoscope.CameraSettings) string {
+	whiteBalance := autoWhiteBalance
+	if !s.AutoWhiteBalance {
+		whiteBalance = fmt.Sprintf(
+			"%s (red gain %g, blue gain %g)",
+			manualWhiteBalance, s.WhiteBalanceRedGain, s.WhiteBalanceBlueGain,
+		)
+	}
+	return fmt.Sprintf(
+		"ISO %d, shutter speed %d us, white balance %s", s.ISO, s.ShutterSpeed, whiteBalance,
+	)
+}
+
+// Imager
+
+func describeImager(s planktoscope.Imager) string {
+	return describeActivity(s.StateKnown, s.Imaging, s.Interrupted, "imaging")
+}
+
+func describeImagerSettings(s planktoscope.Imager, settings planktoscope.ImagerSettings) string {
+	description := fmt.Sprintf(
+		"%d frames, %s, %g mL per step, %g s delay",
+		settings.Steps, describeDirection(settings.Forward), settings.StepVolume, settings.StepDelay,
+	)
+	if s.StateKnown && s.TotalFrames > 0 {
+		description = fmt.Sprintf(
+			"frame %d/%d; %s", s.CurrentFrame, s.TotalFrames, description,
+		)
+	}
+	return description
+}
+
+// Segmenter
+
+func describeSegmenter(s planktoscope.Segmenter) string {
+	return describeActivity(s.StateKnown, s.Segmenting, s.Interrupted, "segmenting")
+}
+
+func describeSegmenterSettings(
+	s planktoscope.Segmenter, settings planktoscope.SegmenterSettings,
+) string {
+	description := fmt.Sprintf(
+		"processing ID %d, paths %v", settings.ProcessingID, settings.Paths,
+	)
+	if s.StateKnown && (s.Segmenting || s.Interrupted || s.CurrentFrame > 0) {
+		description = fmt.Sprintf(
+			"frame %d, last object %d; %s", s.CurrentFrame, s.LastObject, description,
+		)
+	}
+	return description
+}
@@ -9,6 +9,177 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Helpers
+
+// awaitPublished waits until the token for a command published on the topic completes, returning
+// a PublishError if the command couldn't be published. If the timeout fires first (e.g. because
+// the command was queued while the client is disconnected from the MQTT broker), it returns a
+// NoResponseError for the subsystem.
+func (c *Client) awaitPublished(
+	ctx context.Context, subsystem, topic string, token Token, timeout <-chan time.Time,
+) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return &NoResponseError{Subsystem: subsystem, Timeout: c.Config.ResponseTimeout}
+	case <-token.Done():
+	}
+	if err := token.Error(); err != nil {
+		return &PublishError{Topic: topic, Err: err}
+	}
+	return nil
+}
+
+// statusTopics maps each subsystem to the filter of the topics on which the PlanktoScope
+// publishes statuses in response to commands for the subsystem.
+var statusTopics = map[string]string{
+	pumpSubsystem:      "status/pump",
+	cameraSubsystem:    "status/imager",
+	imagerSubsystem:    "status/imager",
+	segmenterSubsystem: "status/segmenter/#",
+}
+
+// statusReceivedSince checks whether a status message on a topic matching the filter was received
+// at or after the specified time.
+func (c *Client) statusReceivedSince(filter string, since time.Time) bool {
+	c.stateL.RLock()
+	defer c.stateL.RUnlock()
+
+	for topic, received := range c.statusReceived {
+		if MatchTopic(filter, topic) && !received.Before(since) {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitResponse waits until the PlanktoScope publishes a status for the subsystem after the time
+// when a command was sent, returning a NoResponseError if the timeout fires first. The client also
+// receives the echo of its own command from the MQTT broker, but that echo doesn't count as a
+// response, since the broker sends it even if the PlanktoScope isn't running.
+func (c *Client) awaitResponse(
+	ctx context.Context, subsystem string, sent time.Time, timeout <-chan time.Time,
+) error {
+	if c.dryRun {
+		// The PlanktoScope never receives commands in a dry run, so it never responds
+		return nil
+	}
+	filter := statusTopics[subsystem]
+	for {
+		statusUpdated := c.statusB.Broadcasted()
+		if c.statusReceivedSince(filter, sent) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return &NoResponseError{Subsystem: subsystem, Timeout: c.Config.ResponseTimeout}
+		case <-statusUpdated:
+		}
+	}
+}
+
+// responseTimeout returns a channel which fires after the configured response timeout, and a
+// function to release the associated timer. If no response timeout is configured, the channel
+// never fires. Each action uses a single timer for both publishing its commands and waiting for
+// the PlanktoScope to respond to them.
+func (c *Client) responseTimeout() (timeout <-chan time.Time, stop func()) {
+	if c.Config.ResponseTimeout <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(c.Config.ResponseTimeout)
+	return timer.C, func() { timer.Stop() }
+}
+
+// operationState is the state of a subsystem's operation, projected from the client's state.
+type operationState struct {
+	StateKnown bool
+	// Start is the time when the subsystem's latest operation started.
+	Start       time.Time
+	Running     bool
+	Interrupted bool
+}
+
+// completion describes an operation which ran to completion.
+type completion struct {
+	Start  time.Time
+	End    time.Time
+	Status string
+	// Last is the client's last state observed after the operation started.
+	Last Planktoscope
+}
+
+// awaitCompletion waits until the subsystem's state, as projected by the operation function,
+// shows that an operation started after the time when its command was sent and then finished or
+// been interrupted. The stateUpdated channel must be taken from the subsystem's broadcasted
+// function before the command is sent, so that no state updates are missed. The response timeout
+// only applies until the operation starts, since operations may run for arbitrarily long.
+func (c *Client) awaitCompletion(
+	ctx context.Context, subsystem string, sent time.Time, timeout <-chan time.Time,
+	stateUpdated <-chan struct{}, broadcasted func() <-chan struct{},
+	operation func(s Planktoscope) operationState,
+) (result completion, err error) {
+	if c.dryRun {
+		return result, nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-timeout:
+			return result, &NoResponseError{Subsystem: subsystem, Timeout: c.Config.ResponseTimeout}
+		case <-stateUpdated:
+		}
+		stateUpdated = broadcasted()
+		// The client broadcasts state updates for every subsystem when the connection is lost, and
+		// we can't know whether the operation finishes while the client is disconnected
+		current := c.GetState()
+		if !current.Connection.Connected {
+			return result, &ConnectionLostError{Subsystem: subsystem}
+		}
+		// An older start time means that the operation hasn't yet started, even if the subsystem
+		// has reported a final status (e.g. for a previous operation interrupted by our command)
+		state := operation(current)
+		if !state.StateKnown || state.Start.Before(sent) {
+			continue
+		}
+		if result.Start.IsZero() {
+			result.Start = state.Start
+			timeout = nil
+		}
+		result.Last = current
+		if state.Running {
+			continue
+		}
+
+		result.End = time.Now()
+		if state.Interrupted {
+			result.Status = StatusInterrupted
+			return result, &InterruptedError{Subsystem: subsystem}
+		}
+		result.Status = StatusDone
+		return result, nil
+	}
+}
+
+const (
+	// StatusDone is the final status of an operation which the PlanktoScope completed.
+	StatusDone = doneStatus
+	// StatusInterrupted is the final status of an operation which the PlanktoScope interrupted
+	// before completing it.
+	StatusInterrupted = interruptedStatus
+)
+
+const (
+	pumpSubsystem      = "pump"
+	cameraSubsystem    = "camera"
+	imagerSubsystem    = "imager"
+	segmenterSubsystem = "segmenter"
+)
+
 // Pump Actions
 
 type PlanktoscopePumpParams struct {
@@ -18,33 +189,115 @@ type PlanktoscopePumpParams struct {
 }
 
 func (c *Client) RunPumpAction(ctx context.Context, p PlanktoscopePumpParams) error {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	prevState := c.GetState().Pump
+	sent := time.Now()
 	token, err := c.StartPump(p.Forward, p.Volume, p.Flowrate)
 	if err != nil {
 		return errors.Wrap(err, "couldn't send command to start the pump")
 	}
-	stateUpdated := c.PumpStateBroadcasted()
-	// TODO: instead of always waiting forever, have an action-configured optional timeout before
-	// returning an error that we haven't heard any pump updates from the planktoscope.
-	if token.Wait(); token.Error() != nil {
-		return token.Error()
+	if err = c.awaitPublished(ctx, pumpSubsystem, "actuator/pump", token, timeout); err != nil {
+		return err
+	}
+	if err = c.awaitResponse(ctx, pumpSubsystem, sent, timeout); err != nil {
+		return err
+	}
+	if state := c.GetState().Pump; state != prevState && state.Interrupted {
+		return &InterruptedError{Subsystem: pumpSubsystem}
 	}
-	<-stateUpdated
 	return nil
 }
 
+// PumpResult describes the outcome of a pump operation which ran to completion.
+type PumpResult struct {
+	Start  time.Time
+	End    time.Time
+	Status string
+}
+
+// RunPumpActionToCompletion starts the pump and waits until the PlanktoScope reports that the pump
+// has started and then finished or been interrupted. Unlike RunPumpAction, it isn't satisfied by
+// the PlanktoScope's first response to its command.
+func (c *Client) RunPumpActionToCompletion(
+	ctx context.Context, p PlanktoscopePumpParams,
+) (result PumpResult, err error) {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	sent := time.Now()
+	stateUpdated := c.PumpStateBroadcasted()
+	token, err := c.StartPump(p.Forward, p.Volume, p.Flowrate)
+	if err != nil {
+		return result, errors.Wrap(err, "couldn't send command to start the pump")
+	}
+	if err = c.awaitPublished(ctx, pumpSubsystem, "actuator/pump", token, timeout); err != nil {
+		return result, err
+	}
+	done, err := c.awaitCompletion(
+		ctx, pumpSubsystem, sent, timeout, stateUpdated, c.PumpStateBroadcasted, pumpOperation,
+	)
+	return PumpResult{Start: done.Start, End: done.End, Status: done.Status}, err
+}
+
+// pumpOperation projects the state of the pump's operation from the client's state.
+func pumpOperation(s Planktoscope) operationState {
+	return operationState{
+		StateKnown:  s.Pump.StateKnown,
+		Start:       s.Pump.Start,
+		Running:     s.Pump.Pumping,
+		Interrupted: s.Pump.Interrupted,
+	}
+}
+
 func (c *Client) RunStopPumpAction(ctx context.Context) error {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	sent := time.Now()
 	token, err := c.StopPump()
 	if err != nil {
 		return errors.Wrap(err, "couldn't send command to stop the pump")
 	}
-	stateUpdated := c.PumpStateBroadcasted()
-	// TODO: instead of always waiting forever, have an action-configured optional timeout before
-	// returning an error that we haven't heard any pump updates from the planktoscope.
-	if token.Wait(); token.Error() != nil {
-		return token.Error()
+	if err = c.awaitPublished(ctx, pumpSubsystem, "actuator/pump", token, timeout); err != nil {
+		return err
+	}
+	return c.awaitResponse(ctx, pumpSubsystem, sent, timeout)
+}
+
+// Camera Actions
+
+type PlanktoscopeCameraParams struct {
+	ISO                  uint64  `hcl:"iso"`
+	ShutterSpeed         uint64  `hcl:"shutter_speed"`
+	AutoWhiteBalance     bool    `hcl:"auto_white_balance"`
+	WhiteBalanceRedGain  float64 `hcl:"white_balance_red_gain,optional"`
+	WhiteBalanceBlueGain float64 `hcl:"white_balance_blue_gain,optional"`
+}
+
+// Settings returns the camera settings described by the params.
+func (p PlanktoscopeCameraParams) Settings() CameraSettings {
+	return CameraSettings{
+		ISO:                  p.ISO,
+		ShutterSpeed:         p.ShutterSpeed,
+		AutoWhiteBalance:     p.AutoWhiteBalance,
+		WhiteBalanceRedGain:  p.WhiteBalanceRedGain,
+		WhiteBalanceBlueGain: p.WhiteBalanceBlueGain,
 	}
-	<-stateUpdated
-	return nil
+}
+
+func (c *Client) RunCameraAction(ctx context.Context, p PlanktoscopeCameraParams) error {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	sent := time.Now()
+	token, err := c.SetCamera(
+		p.ISO, p.ShutterSpeed, p.AutoWhiteBalance, p.WhiteBalanceRedGain, p.WhiteBalanceBlueGain,
+	)
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to change camera settings")
+	}
+	if err = c.awaitPublished(ctx, cameraSubsystem, "imager/image", token, timeout); err != nil {
+		return err
+	}
+	return c.awaitResponse(ctx, cameraSubsystem, sent, timeout)
 }
 
 // Imager Actions
@@ -58,70 +311,124 @@ type PlanktoscopeImagingParams struct {
 	Steps           uint64  `hcl:"steps"`
 }
 
+// startImaging sets the sample metadata and then sends the command to start imaging, returning
+// the time when the command to start imaging was sent.
+func (c *Client) startImaging(
+	ctx context.Context, p PlanktoscopeImagingParams, timeout <-chan time.Time,
+) (sent time.Time, err error) {
+	// The PlanktoScope responds to the metadata with a status, so we must wait for that response
+	// before sending the next command, so that it isn't mistaken for a response to that command
+	if err = c.setMetadata(ctx, p.SampleProjectID, p.SampleID, timeout); err != nil {
+		return sent, err
+	}
+	sent = time.Now()
+	token, err := c.StartImaging(p.Forward, p.StepVolume, p.StepDelay, p.Steps)
+	if err != nil {
+		return sent, errors.Wrap(err, "couldn't send command to start imaging")
+	}
+	return sent, c.awaitPublished(ctx, imagerSubsystem, "imager/image", token, timeout)
+}
+
 func (c *Client) RunImagingAction(ctx context.Context, p PlanktoscopeImagingParams) error {
-	token, err := c.SetMetadata(p.SampleProjectID, p.SampleID, time.Now())
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	prevState := c.GetState().Imager
+	sent, err := c.startImaging(ctx, p, timeout)
 	if err != nil {
 		return err
 	}
-	if token.Wait(); token.Error() != nil {
-		return token.Error()
+	if err = c.awaitResponse(ctx, imagerSubsystem, sent, timeout); err != nil {
+		return err
 	}
-	token, err = c.StartImaging(p.Forward, p.StepVolume, p.StepDelay, p.Steps)
-	if err != nil {
-		return errors.Wrap(err, "couldn't send command to start imaging")
+	if state := c.GetState().Imager; state != prevState && state.Interrupted {
+		return &InterruptedError{Subsystem: imagerSubsystem}
 	}
+	return nil
+}
+
+// ImagingResult describes the outcome of an image acquisition routine which ran to completion.
+type ImagingResult struct {
+	Start  time.Time
+	End    time.Time
+	Status string
+	Frames uint64
+}
+
+// RunImagingActionToCompletion sets the sample metadata, starts imaging, and waits until the
+// PlanktoScope reports that imaging has started and then finished or been interrupted. Unlike
+// RunImagingAction, it isn't satisfied by the PlanktoScope's first response to its command.
+func (c *Client) RunImagingActionToCompletion(
+	ctx context.Context, p PlanktoscopeImagingParams,
+) (result ImagingResult, err error) {
+	timeout, stop := c.responseTimeout()
+	defer stop()
 	stateUpdated := c.ImagerStateBroadcasted()
-	// TODO: instead of always waiting forever, have an action-configured optional timeout before
-	// returning an error that we haven't heard any imager updates from the planktoscope.
-	if token.Wait(); token.Error() != nil {
-		return token.Error()
+	sent, err := c.startImaging(ctx, p, timeout)
+	if err != nil {
+		return result, err
+	}
+	done, err := c.awaitCompletion(
+		ctx, imagerSubsystem, sent, timeout, stateUpdated, c.ImagerStateBroadcasted,
+		imagerOperation,
+	)
+	return ImagingResult{
+		Start: done.Start, End: done.End, Status: done.Status,
+		Frames: done.Last.Imager.CurrentFrame,
+	}, err
+}
+
+// imagerOperation projects the state of the imager's operation from the client's state.
+func imagerOperation(s Planktoscope) operationState {
+	return operationState{
+		StateKnown:  s.Imager.StateKnown,
+		Start:       s.Imager.Start,
+		Running:     s.Imager.Imaging,
+		Interrupted: s.Imager.Interrupted,
 	}
-	<-stateUpdated
-	return nil
 }
 
 func (c *Client) RunStopImagingAction(ctx context.Context) error {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	sent := time.Now()
 	token, err := c.StopImaging()
 	if err != nil {
 		return errors.Wrap(err, "couldn't send command to stop imaging")
 	}
-	stateUpdated := c.ImagerStateBroadcasted()
-	// TODO: instead of always waiting forever, have an action-configured optional timeout before
-	// returning an error that we haven't heard any imager updates from the planktoscope.
-	if token.Wait(); token.Error() != nil {
-		return token.Error()
+	if err = c.awaitPublished(ctx, imagerSubsystem, "imager/image", token, timeout); err != nil {
+		return err
 	}
-	<-stateUpdated
-	return nil
+	return c.awaitResponse(ctx, imagerSubsystem, sent, timeout)
 }
 
-// Controller Action
+// Metadata Actions
 
-func (c *Client) RunControllerAction(ctx context.Context, command string, params hcl.Body) error {
-	switch command {
-	default:
-		return errors.Errorf("unrecognized planktoscope controller command %s", command)
-	case "pump":
-		var p PlanktoscopePumpParams
-		if err := gohcl.DecodeBody(params, nil, &p); err != nil {
-			return errors.Wrapf(
-				err, "couldn't decode params of planktoscope controller command %s", command,
-			)
-		}
-		return c.RunPumpAction(ctx, p)
-	case "stop-pump":
-		return c.RunStopPumpAction(ctx)
-	case "image":
-		var p PlanktoscopeImagingParams
-		if err := gohcl.DecodeBody(params, nil, &p); err != nil {
-			return errors.Wrapf(
-				err, "couldn't decode params of planktoscope controller command %s", command,
-			)
-		}
-		return c.RunImagingAction(ctx, p)
-	case "stop-imaging":
-		return c.RunStopImagingAction(ctx)
+type PlanktoscopeMetadataParams struct {
+	SampleProjectID string `hcl:"sample_project_id"`
+	SampleID        string `hcl:"sample_id"`
+}
+
+// RunMetadataAction sets the sample metadata for subsequent image acquisition routines, with the
+// current time as the acquisition time, and waits for the PlanktoScope to respond.
+func (c *Client) RunMetadataAction(ctx context.Context, p PlanktoscopeMetadataParams) error {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	return c.setMetadata(ctx, p.SampleProjectID, p.SampleID, timeout)
+}
+
+// setMetadata sets the sample metadata and waits for the PlanktoScope to respond.
+func (c *Client) setMetadata(
+	ctx context.Context, sampleProjectID, sampleID string, timeout <-chan time.Time,
+) error {
+	sent := time.Now()
+	token, err := c.SetMetadata(sampleProjectID, sampleID, sent)
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to set sample metadata")
 	}
+	if err = c.awaitPublished(ctx, imagerSubsystem, "imager/image", token, timeout); err != nil {
+		return err
+	}
+	return c.awaitResponse(ctx, imagerSubsystem, sent, timeout)
 }
 
 // Segmenter Actions
@@ -136,6 +443,10 @@ type PlanktoscopeSegmentingParams struct {
 }
 
 func (c *Client) RunSegmentingAction(ctx context.Context, p PlanktoscopeSegmentingParams) error {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	prevState := c.GetState().Segmenter
+	sent := time.Now()
 	token, err := c.StartSegmenting(
 		p.Paths, p.ProcessingID,
 		p.Recurse, p.ForceReprocessing, p.KeepObjects, p.ExportEcoTaxa,
@@ -143,12 +454,135 @@ func (c *Client) RunSegmentingAction(ctx context.Context, p PlanktoscopeSegmenti
 	if err != nil {
 		return errors.Wrap(err, "couldn't send command to start segmenting")
 	}
+	err = c.awaitPublished(ctx, segmenterSubsystem, "segmenter/segment", token, timeout)
+	if err != nil {
+		return err
+	}
+	if err = c.awaitResponse(ctx, segmenterSubsystem, sent, timeout); err != nil {
+		return err
+	}
+	if state := c.GetState().Segmenter; state != prevState && state.Interrupted {
+		return &InterruptedError{Subsystem: segmenterSubsystem}
+	}
+	return nil
+}
+
+// SegmentingResult describes the outcome of a data processing routine which ran to completion.
+type SegmentingResult struct {
+	Start      time.Time
+	End        time.Time
+	Status     string
+	Frames     uint64
+	LastObject uint64
+}
+
+// RunSegmentingActionToCompletion starts segmenting and waits until the PlanktoScope reports that
+// segmentation has started and then finished or been interrupted. Unlike RunSegmentingAction, it
+// isn't satisfied by the PlanktoScope's first response to its command.
+func (c *Client) RunSegmentingActionToCompletion(
+	ctx context.Context, p PlanktoscopeSegmentingParams,
+) (result SegmentingResult, err error) {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	sent := time.Now()
 	stateUpdated := c.SegmenterStateBroadcasted()
-	// TODO: instead of always waiting forever, have an action-configured optional timeout before
-	// returning an error that we haven't heard any segmenter updates from the planktoscope.
-	if token.Wait(); token.Error() != nil {
-		return token.Error()
+	token, err := c.StartSegmenting(
+		p.Paths, p.ProcessingID,
+		p.Recurse, p.ForceReprocessing, p.KeepObjects, p.ExportEcoTaxa,
+	)
+	if err != nil {
+		return result, errors.Wrap(err, "couldn't send command to start segmenting")
+	}
+	err = c.awaitPublished(ctx, segmenterSubsystem, "segmenter/segment", token, timeout)
+	if err != nil {
+		return result, err
+	}
+	done, err := c.awaitCompletion(
+		ctx, segmenterSubsystem, sent, timeout, stateUpdated, c.SegmenterStateBroadcasted,
+		segmenterOperation,
+	)
+	return SegmentingResult{
+		Start: done.Start, End: done.End, Status: done.Status,
+		Frames: done.Last.Segmenter.CurrentFrame, LastObject: done.Last.Segmenter.LastObject,
+	}, err
+}
+
+// segmenterOperation projects the state of the segmenter's operation from the client's state.
+func segmenterOperation(s Planktoscope) operationState {
+	return operationState{
+		StateKnown:  s.Segmenter.StateKnown,
+		Start:       s.Segmenter.Start,
+		Running:     s.Segmenter.Segmenting,
+		Interrupted: s.Segmenter.Interrupted,
+	}
+}
+
+func (c *Client) RunStopSegmentingAction(ctx context.Context) error {
+	timeout, stop := c.responseTimeout()
+	defer stop()
+	sent := time.Now()
+	token, err := c.StopSegmenting()
+	if err != nil {
+		return errors.Wrap(err, "couldn't send command to stop segmenting")
+	}
+	err = c.awaitPublished(ctx, segmenterSubsystem, "segmenter/segment", token, timeout)
+	if err != nil {
+		return err
+	}
+	return c.awaitResponse(ctx, segmenterSubsystem, sent, timeout)
+}
+
+// Controller Action
+
+// decodeControllerParams decodes the params of a planktoscope controller command.
+func decodeControllerParams(command string, params hcl.Body, p interface{}) error {
+	if diags := gohcl.DecodeBody(params, nil, p); diags.HasErrors() {
+		return errors.Wrapf(
+			diags, "couldn't decode params of planktoscope controller command %s", command,
+		)
 	}
-	<-stateUpdated
 	return nil
 }
+
+func (c *Client) RunControllerAction(ctx context.Context, command string, params hcl.Body) error {
+	switch command {
+	default:
+		return errors.Errorf("unrecognized planktoscope controller command %s", command)
+	case "pump":
+		var p PlanktoscopePumpParams
+		if err := decodeControllerParams(command, params, &p); err != nil {
+			return err
+		}
+		return c.RunPumpAction(ctx, p)
+	case "stop-pump":
+		return c.RunStopPumpAction(ctx)
+	case "camera":
+		var p PlanktoscopeCameraParams
+		if err := decodeControllerParams(command, params, &p); err != nil {
+			return err
+		}
+		return c.RunCameraAction(ctx, p)
+	case "metadata":
+		var p PlanktoscopeMetadataParams
+		if err := decodeControllerParams(command, params, &p); err != nil {
+			return err
+		}
+		return c.RunMetadataAction(ctx, p)
+	case "image":
+		var p PlanktoscopeImagingParams
+		if err := decodeControllerParams(command, params, &p); err != nil {
+			return err
+		}
+		return c.RunImagingAction(ctx, p)
+	case "stop-imaging":
+		return c.RunStopImagingAction(ctx)
+	case "segment":
+		var p PlanktoscopeSegmentingParams
+		if err := decodeControllerParams(command, params, &p); err != nil {
+			return err
+		}
+		return c.RunSegmentingAction(ctx, p)
+	case "stop-segment":
+		return c.RunStopSegmentingAction(ctx)
+	}
+}
@@ -0,0 +1,335 @@
+package planktoscope
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pendingToken is a Token for an operation which never completes, e.g. a command which was queued
+// for publishing while the client is disconnected from the MQTT broker.
+type pendingToken struct{}
+
+func (pendingToken) Wait() bool {
+	select {}
+}
+
+func (pendingToken) WaitTimeout(timeout time.Duration) bool {
+	time.Sleep(timeout)
+	return false
+}
+
+func (pendingToken) Done() <-chan struct{} {
+	return nil
+}
+
+func (pendingToken) Error() error {
+	return nil
+}
+
+// respondWith makes the transport's publish hook simulate a PlanktoScope which publishes the
+// responses mapped from a command's topic whenever a command is published on that topic.
+func respondWith(transport *fakeTransport, responses map[string][]RawMessage) {
+	transport.onPublish = func(m RawMessage) Token {
+		go func() {
+			for _, response := range responses[m.Topic] {
+				transport.receive(response)
+			}
+		}()
+		return NewCompletedToken(nil)
+	}
+}
+
+func status(topic, status string) RawMessage {
+	return RawMessage{Topic: topic, Payload: `{"status":"` + status + `"}`}
+}
+
+func isPublishError(err error) bool {
+	var target *PublishError
+	return errors.As(err, &target)
+}
+
+func isNoResponseError(err error) bool {
+	var target *NoResponseError
+	return errors.As(err, &target)
+}
+
+func isInterruptedError(err error) bool {
+	var target *InterruptedError
+	return errors.As(err, &target)
+}
+
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+func runPump(ctx context.Context, c *Client) error {
+	return c.RunPumpAction(ctx, PlanktoscopePumpParams{Forward: true, Volume: 1, Flowrate: 1})
+}
+
+func runCamera(ctx context.Context, c *Client) error {
+	return c.RunCameraAction(ctx, PlanktoscopeCameraParams{
+		ISO: 100, ShutterSpeed: 125, AutoWhiteBalance: true,
+	})
+}
+
+func runImaging(ctx context.Context, c *Client) error {
+	return c.RunImagingAction(ctx, PlanktoscopeImagingParams{
+		SampleProjectID: "project", SampleID: "sample", Forward: true,
+		StepVolume: 0.04, StepDelay: 0.5, Steps: 10,
+	})
+}
+
+func runStopSegmenting(ctx context.Context, c *Client) error {
+	return c.RunStopSegmentingAction(ctx)
+}
+
+func TestActions(t *testing.T) {
+	const responseTimeout = 100 * time.Millisecond
+	for _, test := range []struct {
+		name string
+		run  func(ctx context.Context, c *Client) error
+		// responses maps the topics of commands to the messages published in response by the
+		// simulated PlanktoScope.
+		responses map[string][]RawMessage
+		// publish, if set, determines the token returned for every published command.
+		publish func() Token
+		// stale lists messages published by the PlanktoScope before the action runs.
+		stale []RawMessage
+		// cancelAfter, if positive, is the time after which the action's context is canceled.
+		cancelAfter time.Duration
+		// responseTimeout overrides the default response timeout, if set; a negative timeout
+		// disables the response timeout.
+		responseTimeout time.Duration
+		expectErr       func(err error) bool
+	}{
+		{
+			name: "pump started",
+			run:  runPump,
+			responses: map[string][]RawMessage{
+				"actuator/pump": {status("status/pump", "Started")},
+			},
+		},
+		{
+			name: "pump interrupted",
+			run:  runPump,
+			responses: map[string][]RawMessage{
+				"actuator/pump": {status("status/pump", "Interrupted")},
+			},
+			expectErr: isInterruptedError,
+		},
+		{
+			name: "pump publish failed",
+			run:  runPump,
+			publish: func() Token {
+				return NewCompletedToken(errors.New("connection refused"))
+			},
+			expectErr: isPublishError,
+		},
+		{
+			// Paho queues commands published while the client is reconnecting, and never completes
+			// their tokens if the client can't reconnect
+			name:      "pump publish pending",
+			run:       runPump,
+			publish:   func() Token { return pendingToken{} },
+			expectErr: isNoResponseError,
+		},
+		{
+			// The client receives the echo of its own command from the broker even if the
+			// PlanktoScope isn't running, so the echo must not count as a response
+			name:      "pump echo only",
+			run:       runPump,
+			expectErr: isNoResponseError,
+		},
+		{
+			name:      "pump stale status",
+			run:       runPump,
+			stale:     []RawMessage{status("status/pump", "Done")},
+			expectErr: isNoResponseError,
+		},
+		{
+			name:            "pump canceled",
+			run:             runPump,
+			cancelAfter:     50 * time.Millisecond,
+			responseTimeout: -1,
+			expectErr:       isCanceled,
+		},
+		{
+			name: "camera updated",
+			run:  runCamera,
+			responses: map[string][]RawMessage{
+				"imager/image": {status("status/imager", "Camera settings updated")},
+			},
+		},
+		{
+			name:      "camera unresponsive",
+			run:       runCamera,
+			responses: map[string][]RawMessage{"imager/image": {status("status/pump", "Done")}},
+			expectErr: isNoResponseError,
+		},
+		{
+			name: "segmenting stopped",
+			run:  runStopSegmenting,
+			responses: map[string][]RawMessage{
+				"segmenter/segment": {status("status/segmenter", "Interrupted")},
+			},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			transport := newFakeTransport()
+			timeout := responseTimeout
+			if test.responseTimeout != 0 {
+				timeout = test.responseTimeout
+			}
+			client := newFakeClient(t, transport, timeout)
+			statusUpdated := client.statusB.Broadcasted()
+			for _, m := range test.stale {
+				transport.receive(m)
+			}
+			if len(test.stale) > 0 {
+				awaitBroadcast(t, statusUpdated, "stale status")
+			}
+			respondWith(transport, test.responses)
+			if test.publish != nil {
+				transport.onPublish = func(m RawMessage) Token {
+					return test.publish()
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancelAfter > 0 {
+				time.AfterFunc(test.cancelAfter, cancel)
+			}
+			err := test.run(ctx, client)
+			if test.expectErr == nil {
+				if err != nil {
+					t.Errorf("action failed: %s", err)
+				}
+				return
+			}
+			if err == nil || !test.expectErr(err) {
+				t.Errorf("action returned unexpected error %v", err)
+			}
+		})
+	}
+}
+
+// respondInOrder makes the transport's publish hook simulate a PlanktoScope which publishes each
+// of the responses in response to each successive command, until it runs out of responses.
+func respondInOrder(transport *fakeTransport, responses ...RawMessage) {
+	transport.onPublish = func(m RawMessage) Token {
+		if len(responses) > 0 {
+			go transport.receive(responses[0])
+			responses = responses[1:]
+		}
+		return NewCompletedToken(nil)
+	}
+}
+
+func TestImagingActionWaitsForMetadataResponse(t *testing.T) {
+	transport := newFakeTransport()
+	client := newFakeClient(t, transport, time.Second)
+	respondInOrder(
+		transport, status("status/imager", "Config updated"), status("status/imager", "Started"),
+	)
+	if err := runImaging(context.Background(), client); err != nil {
+		t.Fatalf("action failed: %s", err)
+	}
+	if topics := transport.publishedTopics(); len(topics) != 2 {
+		t.Errorf("client published %d commands instead of 2", len(topics))
+	}
+	if state := client.GetState().Imager; !state.Imaging {
+		t.Errorf("imager state %+v isn't imaging after the PlanktoScope started imaging", state)
+	}
+
+	// The response to the sample metadata must not be mistaken for a response to the command to
+	// start imaging
+	transport = newFakeTransport()
+	client = newFakeClient(t, transport, 100*time.Millisecond)
+	respondInOrder(transport, status("status/imager", "Config updated"))
+	if err := runImaging(context.Background(), client); !isNoResponseError(err) {
+		t.Errorf("action returned unexpected error %v", err)
+	}
+}
+
+func TestActionToCompletionReturnsOnConnectionLoss(t *testing.T) {
+	transport := newFakeTransport()
+	client := newFakeClient(t, transport, time.Second)
+	respondWith(transport, map[string][]RawMessage{
+		"actuator/pump": {status("status/pump", "Started")},
+	})
+	pumpUpdated := client.PumpStateBroadcasted()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.RunPumpActionToCompletion(
+			context.Background(), PlanktoscopePumpParams{Forward: true, Volume: 1, Flowrate: 1},
+		)
+		errs <- err
+	}()
+	for !client.GetState().Pump.Pumping {
+		awaitBroadcast(t, pumpUpdated, "pump state")
+		pumpUpdated = client.PumpStateBroadcasted()
+	}
+
+	// The response timeout no longer applies once the pump has started, so the action must not
+	// keep waiting for a status which can't arrive
+	transport.loseConnection(errors.New("connection reset"))
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("action didn't return after the connection was lost")
+	case err := <-errs:
+		var target *ConnectionLostError
+		if !errors.As(err, &target) {
+			t.Errorf("action returned unexpected error %v", err)
+		}
+	}
+}
+
+func TestPumpActionToCompletionIgnoresFinalStatusBeforeStart(t *testing.T) {
+	transport := newFakeTransport()
+	client := newFakeClient(t, transport, time.Second)
+	// The PlanktoScope interrupts the pump's previous operation when it receives a new command
+	respondWith(transport, map[string][]RawMessage{
+		"actuator/pump": {status("status/pump", "Interrupted")},
+	})
+	pumpUpdated := client.PumpStateBroadcasted()
+	type outcome struct {
+		result PumpResult
+		err    error
+	}
+	outcomes := make(chan outcome, 1)
+	go func() {
+		result, err := client.RunPumpActionToCompletion(
+			context.Background(), PlanktoscopePumpParams{Forward: true, Volume: 1, Flowrate: 1},
+		)
+		outcomes <- outcome{result: result, err: err}
+	}()
+	for !client.GetState().Pump.Interrupted {
+		awaitBroadcast(t, pumpUpdated, "pump state")
+		pumpUpdated = client.PumpStateBroadcasted()
+	}
+	// Give the action a chance to mistake the interruption for the end of its own operation
+	time.Sleep(50 * time.Millisecond)
+
+	transport.receive(status("status/pump", "Started"))
+	for !client.GetState().Pump.Pumping {
+		awaitBroadcast(t, pumpUpdated, "pump state")
+		pumpUpdated = client.PumpStateBroadcasted()
+	}
+	transport.receive(status("status/pump", "Done"))
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("action didn't return after the pump finished")
+	case o := <-outcomes:
+		if o.err != nil {
+			t.Fatalf("action failed: %s", o.err)
+		}
+		if o.result.Status != StatusDone || o.result.End.Before(o.result.Start) {
+			t.Errorf("action returned unexpected result %+v", o.result)
+		}
+	}
+}
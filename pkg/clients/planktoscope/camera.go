@@ -3,8 +3,8 @@ package planktoscope
 import (
 	"encoding/json"
 	"math"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 )
 
@@ -14,7 +14,7 @@ func (c *Client) CameraStateBroadcasted() <-chan struct{} {
 
 // Receive Updates
 
-func (c *Client) updateCameraSettings(newSettings CameraSettings) {
+func (c *Client) updateCameraSettings(newSettings CameraSettings) CameraSettings {
 	c.stateL.Lock()
 	defer c.stateL.Unlock()
 
@@ -34,9 +34,12 @@ func (c *Client) updateCameraSettings(newSettings CameraSettings) {
 	c.cameraSettings.StateKnown = c.cameraSettings.ISO > 0 && c.cameraSettings.ShutterSpeed > 0 &&
 		c.cameraSettings.WhiteBalanceRedGain > 0 && c.cameraSettings.WhiteBalanceBlueGain > 0
 	c.cameraB.BroadcastNext()
+	return c.cameraSettings
 }
 
-func (c *Client) handleCameraSettingsUpdate(_ string, rawPayload []byte) error {
+func (c *Client) handleCameraSettingsUpdate(
+	topic string, received time.Time, rawPayload []byte,
+) error {
 	type CameraSettingsCommand struct {
 		Action   string `json:"action"`
 		Settings struct {
@@ -66,17 +69,66 @@ func (c *Client) handleCameraSettingsUpdate(_ string, rawPayload []byte) error {
 	newSettings.WhiteBalanceBlueGain = payload.Settings.WhiteBalanceGain.Blue / whiteBalanceMultiplier
 
 	// Commit changes
-	c.updateCameraSettings(newSettings)
+	c.emitEvent(CameraSettingsChanged, topic, received, c.updateCameraSettings(newSettings))
 	c.Logger.Debugf("%s: %+v", c.Config.URL, newSettings)
 	return nil
 }
 
 // Send Commands
 
+// CameraISOs lists the ISO values accepted by the PlanktoScope's camera.
+var CameraISOs = []uint64{100, 200, 320, 400, 500, 640, 800}
+
+// CameraShutterSpeeds lists the shutter speeds (in microseconds) accepted by the PlanktoScope's
+// camera.
+var CameraShutterSpeeds = []uint64{125, 250, 500, 1000}
+
+// MaxWhiteBalanceGain is the largest white balance gain accepted by the PlanktoScope's camera.
+const MaxWhiteBalanceGain = 8
+
+func containsUint(values []uint64, value uint64) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateCameraSettings checks whether the camera settings would be accepted by the
+// PlanktoScope's camera. SetCamera doesn't check the settings, so callers which want to reject
+// unsupported settings before sending them should call this function first.
+func ValidateCameraSettings(s CameraSettings) error {
+	if !containsUint(CameraISOs, s.ISO) {
+		return errors.Errorf("unsupported ISO %d (must be one of %v)", s.ISO, CameraISOs)
+	}
+	if !containsUint(CameraShutterSpeeds, s.ShutterSpeed) {
+		return errors.Errorf(
+			"unsupported shutter speed %d (must be one of %v)", s.ShutterSpeed, CameraShutterSpeeds,
+		)
+	}
+	if s.AutoWhiteBalance {
+		return nil
+	}
+	if s.WhiteBalanceRedGain <= 0 || s.WhiteBalanceRedGain > MaxWhiteBalanceGain {
+		return errors.Errorf(
+			"unsupported white balance red gain %g (must be above 0 and at most %d)",
+			s.WhiteBalanceRedGain, MaxWhiteBalanceGain,
+		)
+	}
+	if s.WhiteBalanceBlueGain <= 0 || s.WhiteBalanceBlueGain > MaxWhiteBalanceGain {
+		return errors.Errorf(
+			"unsupported white balance blue gain %g (must be above 0 and at most %d)",
+			s.WhiteBalanceBlueGain, MaxWhiteBalanceGain,
+		)
+	}
+	return nil
+}
+
 func (c *Client) SetCamera(
 	iso, shutterSpeed uint64,
 	autoWhiteBalance bool, whiteBalanceRedGain, whiteBalanceBlueGain float64,
-) (mqtt.Token, error) {
+) (Token, error) {
 	type WhiteBalanceGain struct {
 		Red  float64 `json:"red,omitempty"`
 		Blue float64 `json:"blue,omitempty"`
@@ -120,13 +172,15 @@ func (c *Client) SetCamera(
 	c.stateL.Lock()
 	defer c.stateL.Unlock()
 
-	c.cameraSettings.StateKnown = true
-	c.cameraSettings.ISO = iso
-	c.cameraSettings.ShutterSpeed = shutterSpeed
-	c.cameraSettings.AutoWhiteBalance = autoWhiteBalance
-	c.cameraSettings.WhiteBalanceRedGain = whiteBalanceRedGain
-	c.cameraSettings.WhiteBalanceBlueGain = whiteBalanceBlueGain
+	if !c.dryRun {
+		c.cameraSettings.StateKnown = true
+		c.cameraSettings.ISO = iso
+		c.cameraSettings.ShutterSpeed = shutterSpeed
+		c.cameraSettings.AutoWhiteBalance = autoWhiteBalance
+		c.cameraSettings.WhiteBalanceRedGain = whiteBalanceRedGain
+		c.cameraSettings.WhiteBalanceBlueGain = whiteBalanceBlueGain
+	}
 
-	token := c.MQTT.Publish("imager/image", mqttExactlyOnce, false, marshaled)
+	token := c.Transport.Publish("imager/image", mqttExactlyOnce, false, marshaled)
 	return token, nil
 }
@@ -4,9 +4,10 @@ package planktoscope
 import (
 	"context"
 	"encoding/json"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 )
 
@@ -37,7 +38,7 @@ type Logger interface {
 type Client struct {
 	Config               Config
 	Logger               Logger
-	MQTT                 mqtt.Client
+	Transport            Transport
 	firstConnSuccess     chan struct{}
 	firstConnSuccessOnce *sync.Once
 	logReconnectOnce     *sync.Once
@@ -55,9 +56,53 @@ type Client struct {
 	segmenter         Segmenter
 	segmenterB        *Broadcaster
 	segmenterSettings SegmenterSettings
+	connection        Connection
+	connectionB       *Broadcaster
+	// statusReceived records when the last status message on each topic was received.
+	statusReceived map[string]time.Time
+	statusB        *Broadcaster
+
+	subscriptionsL *sync.Mutex
+	subscriptions  map[*subscription]struct{}
+
+	messageHandlersL *sync.RWMutex
+	messageHandlers  []MessageHandler
+
+	dryRun bool
+	// quietUnhandled suppresses the logging of messages on topics which the client doesn't handle.
+	quietUnhandled bool
+}
+
+// ClientOption customizes a Client made by NewClient.
+type ClientOption func(c *Client)
+
+// WithTransport makes the client exchange messages over the specified Transport, instead of over
+// a PahoTransport made from the MQTT options in the client's Config.
+func WithTransport(t Transport) ClientOption {
+	return func(c *Client) {
+		c.Transport = t
+	}
+}
+
+// WithDryRun makes the client pass every command to the handler instead of sending it, by
+// exchanging messages over a DryRunTransport. In a dry run, sending commands doesn't change the
+// client's state, and actions don't wait for responses from the PlanktoScope.
+func WithDryRun(handler MessageHandler) ClientOption {
+	return func(c *Client) {
+		c.Transport = NewDryRunTransport(handler)
+		c.dryRun = true
+	}
 }
 
-func NewClient(c Config, l Logger) (client *Client, err error) {
+// WithoutUnhandledMessageLogs stops the client from logging the messages which it receives on
+// topics that it doesn't handle, e.g. for programs which print every message themselves.
+func WithoutUnhandledMessageLogs() ClientOption {
+	return func(c *Client) {
+		c.quietUnhandled = true
+	}
+}
+
+func NewClient(c Config, l Logger, options ...ClientOption) (client *Client, err error) {
 	client = &Client{}
 	client.Config = c
 	client.Logger = l
@@ -74,11 +119,24 @@ func NewClient(c Config, l Logger) (client *Client, err error) {
 	client.imagerSettings = DefaultImagerSettings()
 	client.segmenterB = NewBroadcaster()
 	client.segmenterSettings = DefaultSegmenterSettings()
+	client.connectionB = NewBroadcaster()
+	client.statusReceived = make(map[string]time.Time)
+	client.statusB = NewBroadcaster()
+	client.subscriptionsL = &sync.Mutex{}
+	client.subscriptions = make(map[*subscription]struct{})
+	client.messageHandlersL = &sync.RWMutex{}
 
-	c.MQTT.SetOnConnectHandler(client.handleConnected)
-	c.MQTT.SetConnectionLostHandler(client.handleConnectionLost)
-	c.MQTT.SetReconnectingHandler(client.handleReconnecting)
-	client.MQTT = mqtt.NewClient(&c.MQTT)
+	for _, option := range options {
+		option(client)
+	}
+	if client.Transport == nil {
+		client.Transport = NewPahoTransport(c.MQTT)
+	}
+	client.Transport.SetConnectionHandlers(ConnectionHandlers{
+		OnConnect:        client.handleConnected,
+		OnConnectionLost: client.handleConnectionLost,
+		OnReconnecting:   client.handleReconnecting,
+	})
 	return client, nil
 }
 
@@ -94,19 +152,41 @@ func (c *Client) GetState() Planktoscope {
 		ImagerSettings:    c.imagerSettings,
 		Segmenter:         c.segmenter,
 		SegmenterSettings: c.segmenterSettings,
+		Connection:        c.connection,
 	}
 }
 
+// DryRun checks whether the client was made with the WithDryRun option.
+func (c *Client) DryRun() bool {
+	return c.dryRun
+}
+
 // MQTT
 
-func (c *Client) handleConnected(cm mqtt.Client) {
+func (c *Client) ConnectionStateBroadcasted() <-chan struct{} {
+	return c.connectionB.Broadcasted()
+}
+
+func (c *Client) handleConnected() {
 	c.firstConnSuccessOnce.Do(func() {
 		close(c.firstConnSuccess)
 	})
-	c.Logger.Infof("connected as %s to MQTT broker %s", c.Config.ClientID, c.Config.URL)
+	c.stateL.Lock()
+	c.connection.Connected = true
+	c.connection.Reconnecting = false
+	c.connection.LostSince = time.Time{}
+	connection := c.connection
+	c.stateL.Unlock()
+	c.connectionB.BroadcastNext()
+	c.emitEvent(ConnectionChanged, "", time.Now(), connection)
+
+	if !c.dryRun {
+		// A DryRunTransport connects without contacting the MQTT broker
+		c.Logger.Infof("connected as %s to MQTT broker %s", c.Config.ClientID, c.Config.URL)
+	}
 	// FIXME: we might not want to use Once 1 everywhere (depends on which messages are idempotent)
-	token := cm.Subscribe("#", mqttAtLeastOnce, c.handleMessage)
-	go func(t mqtt.Token) {
+	token := c.Transport.Subscribe("#", mqttAtLeastOnce, c.processMessage)
+	go func(t Token) {
 		if t.Wait(); t.Error() != nil {
 			c.Logger.Error(errors.Wrap(t.Error(), "couldn't subscribe to #"))
 		}
@@ -117,19 +197,40 @@ func (c *Client) handleConnected(cm mqtt.Client) {
 	c.logReconnectOnceMu.Unlock()
 }
 
-func (c *Client) handleConnectionLost(_ mqtt.Client, err error) {
+func (c *Client) handleConnectionLost(err error) {
 	c.stateL.Lock()
-	defer c.stateL.Unlock()
-
 	c.pump.StateKnown = false
 	c.cameraSettings.StateKnown = false
 	c.imager.StateKnown = false
 	c.segmenter.StateKnown = false
+	c.connection.Connected = false
+	c.connection.LostSince = time.Now()
+	if err != nil {
+		c.connection.LastError = err.Error()
+	}
+	connection := c.connection
+	c.stateL.Unlock()
+
 	c.Logger.Warn(errors.Wrap(err, "connection lost"))
-	// TODO: notify clients that control has been lost
+	c.connectionB.BroadcastNext()
+	c.pumpB.BroadcastNext()
+	c.cameraB.BroadcastNext()
+	c.imagerB.BroadcastNext()
+	c.segmenterB.BroadcastNext()
+	c.emitEvent(ConnectionChanged, "", connection.LostSince, connection)
 }
 
-func (c *Client) handleReconnecting(_ mqtt.Client, _ *mqtt.ClientOptions) {
+func (c *Client) handleReconnecting() {
+	c.stateL.Lock()
+	notify := !c.connection.Reconnecting
+	c.connection.Reconnecting = true
+	connection := c.connection
+	c.stateL.Unlock()
+	if notify {
+		c.connectionB.BroadcastNext()
+		c.emitEvent(ConnectionChanged, "", time.Now(), connection)
+	}
+
 	c.logReconnectOnceMu.Lock()
 	defer c.logReconnectOnceMu.Unlock()
 
@@ -138,39 +239,58 @@ func (c *Client) handleReconnecting(_ mqtt.Client, _ *mqtt.ClientOptions) {
 	})
 }
 
-func (c *Client) handleMessage(topic mqtt.Client, m mqtt.Message) {
-	broker := c.Config.URL
-	rawPayload := string(m.Payload())
+// recordStatus records when a status message was received, so that actions can check whether the
+// PlanktoScope has responded to a command.
+func (c *Client) recordStatus(m RawMessage) {
+	if !strings.HasPrefix(m.Topic, "status/") {
+		return
+	}
+	c.stateL.Lock()
+	c.statusReceived[m.Topic] = m.Received
+	c.stateL.Unlock()
+	c.statusB.BroadcastNext()
+}
 
-	switch topic := m.Topic(); topic {
+func (c *Client) processMessage(m RawMessage) {
+	c.handleRawMessage(m)
+	// The status is recorded after the message is handled, so that the state resulting from the
+	// status is already known by the time any action waiting for the status checks it
+	defer c.recordStatus(m)
+
+	broker := c.Config.URL
+	rawPayload := []byte(m.Payload)
+	switch topic := m.Topic; topic {
 	default:
+		if c.quietUnhandled {
+			return
+		}
 		var payload interface{}
-		if err := json.Unmarshal(m.Payload(), &payload); err != nil {
+		if err := json.Unmarshal(rawPayload, &payload); err != nil {
 			c.Logger.Errorf(
-				"%s/%s: unparseable payload %s", broker, topic, rawPayload,
+				"%s/%s: unparseable payload %s", broker, topic, m.Payload,
 			)
 			return
 		}
-		c.Logger.Infof("%s/%s: %v", broker, m.Topic(), payload)
+		c.Logger.Infof("%s/%s: %v", broker, topic, payload)
 		return
 	case "actuator/pump", "status/pump":
-		if err := c.handlePumpMessage(topic, m.Payload()); err != nil {
+		if err := c.handlePumpMessage(topic, m.Received, rawPayload); err != nil {
 			c.Logger.Errorf(errors.Wrapf(err, "couldn't handle pump message").Error())
 		}
 	case "imager/image", "status/imager":
-		if err := c.handleImagerMessage(topic, m.Payload()); err != nil {
+		if err := c.handleImagerMessage(topic, m.Received, rawPayload); err != nil {
 			c.Logger.Errorf(errors.Wrapf(err, "couldn't handle imager message").Error())
 		}
 	case "segmenter/segment", "status/segmenter", "status/segmenter/object_id",
 		"status/segmenter/metric":
-		if err := c.handleSegmenterMessage(topic, m.Payload()); err != nil {
+		if err := c.handleSegmenterMessage(topic, m.Received, rawPayload); err != nil {
 			c.Logger.Errorf(errors.Wrapf(err, "couldn't handle segmenter message").Error())
 		}
 	}
 }
 
 func (c *Client) Connect() error {
-	token := c.MQTT.Connect()
+	token := c.Transport.Connect()
 	_ = token.Wait()
 	return errors.Wrapf(token.Error(), "couldn't connect to %s", c.Config.URL)
 }
@@ -180,11 +300,11 @@ func (c *Client) ConnectedAtLeastOnce() <-chan struct{} {
 }
 
 func (c *Client) HasConnection() bool {
-	return c.MQTT.IsConnectionOpen()
+	return c.Transport.IsConnectionOpen()
 }
 
 func (c *Client) Shutdown(ctx context.Context) error {
-	if !c.MQTT.IsConnected() {
+	if !c.Transport.IsConnected() {
 		return nil
 	}
 
@@ -192,9 +312,9 @@ func (c *Client) Shutdown(ctx context.Context) error {
 	var timeout uint
 	select {
 	default:
-		// As of v1.4.2 of paho.mqtt.golang, c.MQTT.Disconnect seems hang beyond our close timeout if
-		// the client never successfully connected - this implies that c.MQTT.IsConnected returns true
-		// even for such clients.
+		// As of v1.4.2 of paho.mqtt.golang, PahoTransport.Disconnect seems hang beyond our close
+		// timeout if the client never successfully connected - this implies that
+		// PahoTransport.IsConnected returns true even for such clients.
 		timeout = 0
 		break
 	case <-c.firstConnSuccess:
@@ -204,7 +324,7 @@ func (c *Client) Shutdown(ctx context.Context) error {
 
 	closedNormally := make(chan struct{})
 	go func() {
-		c.MQTT.Disconnect(timeout)
+		c.Transport.Disconnect(timeout)
 		close(closedNormally)
 	}()
 	select {
@@ -216,9 +336,9 @@ func (c *Client) Shutdown(ctx context.Context) error {
 }
 
 func (c *Client) Close() {
-	if !c.MQTT.IsConnected() {
+	if !c.Transport.IsConnected() {
 		return
 	}
 
-	c.MQTT.Disconnect(0)
+	c.Transport.Disconnect(0)
 }
@@ -0,0 +1,102 @@
+package planktoscope_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+	"github.com/PlanktoScope/cli/pkg/simulator/simulatortest"
+)
+
+func TestPumpActionToCompletion(t *testing.T) {
+	client := simulatortest.NewConnectedClient(t, simulatortest.Speed)
+	params := planktoscope.PlanktoscopePumpParams{Forward: true, Volume: 1, Flowrate: 6}
+	duration := 10 * time.Second / simulatortest.Speed
+
+	for i := 0; i < 2; i++ {
+		// The second run starts with the Done state of the first run, which must not be mistaken
+		// for the completion of the second run
+		sent := time.Now()
+		result, err := client.RunPumpActionToCompletion(context.Background(), params)
+		if err != nil {
+			t.Fatalf("run %d failed: %s", i, err)
+		}
+		if result.Status != planktoscope.StatusDone {
+			t.Errorf(
+				"run %d finished with status %s instead of %s",
+				i, result.Status, planktoscope.StatusDone,
+			)
+		}
+		if result.Start.Before(sent) || result.End.Before(result.Start) {
+			t.Errorf("run %d has times %+v inconsistent with sending at %s", i, result, sent)
+		}
+		if elapsed := time.Since(sent); elapsed < duration {
+			t.Errorf("run %d finished after %s, before the pump could have finished", i, elapsed)
+		}
+	}
+}
+
+func TestPumpActionToCompletionInterrupted(t *testing.T) {
+	client := simulatortest.NewConnectedClient(t, simulatortest.Speed)
+	pumpUpdated := client.PumpStateBroadcasted()
+	type outcome struct {
+		result planktoscope.PumpResult
+		err    error
+	}
+	outcomes := make(chan outcome, 1)
+	go func() {
+		result, err := client.RunPumpActionToCompletion(
+			context.Background(),
+			planktoscope.PlanktoscopePumpParams{Forward: true, Volume: 100, Flowrate: 1},
+		)
+		outcomes <- outcome{result: result, err: err}
+	}()
+	for !client.GetState().Pump.Pumping {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the pump to start")
+		case <-pumpUpdated:
+			pumpUpdated = client.PumpStateBroadcasted()
+		}
+	}
+
+	if err := client.RunStopPumpAction(context.Background()); err != nil {
+		t.Fatalf("couldn't stop the pump: %s", err)
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("action didn't return after the pump was stopped")
+	case o := <-outcomes:
+		var target *planktoscope.InterruptedError
+		if !errors.As(o.err, &target) {
+			t.Errorf("action returned unexpected error %v", o.err)
+		}
+		if o.result.Status != planktoscope.StatusInterrupted {
+			t.Errorf(
+				"action finished with status %s instead of %s",
+				o.result.Status, planktoscope.StatusInterrupted,
+			)
+		}
+	}
+}
+
+func TestImagingActionToCompletion(t *testing.T) {
+	client := simulatortest.NewConnectedClient(t, simulatortest.Speed)
+	const steps = 3
+	result, err := client.RunImagingActionToCompletion(
+		context.Background(),
+		planktoscope.PlanktoscopeImagingParams{
+			SampleProjectID: "project", SampleID: "sample", Forward: true,
+			StepVolume: 0.04, StepDelay: 0.5, Steps: steps,
+		},
+	)
+	if err != nil {
+		t.Fatalf("action failed: %s", err)
+	}
+	if result.Status != planktoscope.StatusDone || result.Frames != steps {
+		t.Errorf("action finished with result %+v instead of %d frames done", result, steps)
+	}
+}
@@ -1,11 +1,18 @@
 package planktoscope
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net/url"
+	"os"
 	"time"
 
 	"github.com/atrox/haikunatorgo"
 	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/pkg/errors"
 	"github.com/sargassum-world/godest/env"
 )
@@ -16,9 +23,21 @@ type Config struct {
 	URL      string
 	ClientID string
 	MQTT     mqtt.ClientOptions
+	// ResponseTimeout is how long actions wait for the PlanktoScope to acknowledge a command before
+	// failing; if it's zero, actions wait indefinitely.
+	ResponseTimeout time.Duration
 }
 
+// GetConfig makes a Config with MQTT settings from environment variables.
 func GetConfig(brokerURL, clientInstanceID string) (c Config, err error) {
+	settings, err := GetMQTTSettings()
+	if err != nil {
+		return Config{}, errors.Wrap(err, "couldn't make MQTT settings")
+	}
+	return NewConfig(brokerURL, clientInstanceID, settings)
+}
+
+func NewConfig(brokerURL, clientInstanceID string, s MQTTSettings) (c Config, err error) {
 	c.URL = brokerURL
 
 	client := env.GetString(envPrefix+"MQTT_CLIENT", "")
@@ -30,15 +49,28 @@ func GetConfig(brokerURL, clientInstanceID string) (c Config, err error) {
 	}
 	c.ClientID = fmt.Sprintf("pslive/%s/ps/%s", client, clientInstanceID)
 
-	options, err := GetMQTTConfig(brokerURL, c.ClientID)
+	options, err := NewMQTTConfig(brokerURL, c.ClientID, s)
 	if err != nil {
 		return Config{}, errors.Wrap(err, "couldn't make MQTT config")
 	}
 	c.MQTT = *options
 
+	if c.ResponseTimeout, err = getResponseTimeout(); err != nil {
+		return Config{}, errors.Wrap(err, "couldn't make response timeout config")
+	}
+
 	return c, nil
 }
 
+func getResponseTimeout() (time.Duration, error) {
+	const defaultTimeout = 10 // default: 10 seconds
+	timeoutRaw, err := env.GetInt64(envPrefix+"RESPONSE_TIMEOUT", defaultTimeout)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(timeoutRaw) * time.Second, nil
+}
+
 func getMQTTConnectTimeout() (time.Duration, error) {
 	const defaultTimeout = 10 // default: 10 seconds
 	timeoutRaw, err := env.GetInt64(envPrefix+"MQTT_CONNECT", defaultTimeout)
@@ -70,7 +102,168 @@ func getMQTTReconnectInterval() (time.Duration, error) {
 	return time.Duration(intervalRaw) * time.Second, nil
 }
 
+// MQTTSettings describes how to authenticate to the MQTT broker and how to secure the connection
+// with TLS.
+type MQTTSettings struct {
+	Username string
+	Password string
+	// CAFile is the path of a PEM-encoded bundle of CA certificates to trust in addition to the
+	// system's CA certificates.
+	CAFile string
+	// CertFile and KeyFile are the paths of a PEM-encoded client certificate and its private key.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables verification of the broker's certificate.
+	InsecureSkipVerify bool
+
+	// ConnectTimeout, ConnectRetryInterval, and ReconnectInterval control how the client connects
+	// and reconnects to the broker; settings should start from DefaultMQTTSettings so that these
+	// aren't left as zero.
+	ConnectTimeout       time.Duration
+	ConnectRetryInterval time.Duration
+	ReconnectInterval    time.Duration
+}
+
+func DefaultMQTTSettings() MQTTSettings {
+	const defaultInterval = 10 * time.Second
+	return MQTTSettings{
+		ConnectTimeout:       defaultInterval,
+		ConnectRetryInterval: defaultInterval,
+		ReconnectInterval:    defaultInterval,
+	}
+}
+
+// MQTTCredentials is the contents of an HCL file with credentials for the MQTT broker.
+type MQTTCredentials struct {
+	Username string `hcl:"username,optional"`
+	Password string `hcl:"password,optional"`
+}
+
+// ReadMQTTCredentials reads credentials for the MQTT broker from an HCL file.
+func ReadMQTTCredentials(path string) (c MQTTCredentials, err error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return MQTTCredentials{}, errors.Wrapf(err, "couldn't read %s", path)
+	}
+	file, diags := hclsyntax.ParseConfig(src, path, hcl.InitialPos)
+	if diags.HasErrors() {
+		return MQTTCredentials{}, errors.Wrapf(diags, "couldn't parse %s", path)
+	}
+	if diags = gohcl.DecodeBody(file.Body, nil, &c); diags.HasErrors() {
+		return MQTTCredentials{}, errors.Wrapf(diags, "couldn't decode %s", path)
+	}
+	return c, nil
+}
+
+// GetMQTTSettings makes MQTTSettings from environment variables. Credentials are read from the
+// file at PLANKTOSCOPE_MQTT_CREDENTIALS_FILE for any credentials which aren't set by
+// PLANKTOSCOPE_MQTT_USERNAME or PLANKTOSCOPE_MQTT_PASSWORD.
+func GetMQTTSettings() (s MQTTSettings, err error) {
+	s.Username = env.GetString(envPrefix+"MQTT_USERNAME", "")
+	s.Password = env.GetString(envPrefix+"MQTT_PASSWORD", "")
+	if path := env.GetString(envPrefix+"MQTT_CREDENTIALS_FILE", ""); path != "" {
+		credentials, err := ReadMQTTCredentials(path)
+		if err != nil {
+			return MQTTSettings{}, errors.Wrap(err, "couldn't read MQTT credentials file")
+		}
+		s = s.WithCredentials(credentials)
+	}
+	s.CAFile = env.GetString(envPrefix+"MQTT_CA_FILE", "")
+	s.CertFile = env.GetString(envPrefix+"MQTT_CERT_FILE", "")
+	s.KeyFile = env.GetString(envPrefix+"MQTT_KEY_FILE", "")
+	if s.InsecureSkipVerify, err = env.GetBool(envPrefix + "MQTT_INSECURE_SKIP_VERIFY"); err != nil {
+		return MQTTSettings{}, errors.Wrap(err, "couldn't make insecure skip verify config")
+	}
+
+	if s.ConnectTimeout, err = getMQTTConnectTimeout(); err != nil {
+		return MQTTSettings{}, errors.Wrap(err, "couldn't make connect timeout config")
+	}
+	if s.ConnectRetryInterval, err = getMQTTConnectRetryInterval(); err != nil {
+		return MQTTSettings{}, errors.Wrap(err, "couldn't make connect retry interval config")
+	}
+	if s.ReconnectInterval, err = getMQTTReconnectInterval(); err != nil {
+		return MQTTSettings{}, errors.Wrap(err, "couldn't make reconnect interval config")
+	}
+	return s, nil
+}
+
+// WithCredentials returns a copy of the settings with the credentials filling in any unset username
+// or password.
+func (s MQTTSettings) WithCredentials(c MQTTCredentials) MQTTSettings {
+	if s.Username == "" {
+		s.Username = c.Username
+	}
+	if s.Password == "" {
+		s.Password = c.Password
+	}
+	return s
+}
+
+// usesTLS checks whether the broker URL has a scheme for which paho.mqtt.golang connects over
+// TLS.
+func usesTLS(brokerURL string) bool {
+	parsed, err := url.Parse(brokerURL)
+	if err != nil {
+		return false
+	}
+	switch parsed.Scheme {
+	default:
+		return false
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+}
+
+// TLSConfig makes a TLS config from the settings, or returns nil if the settings don't customize
+// TLS.
+func (s MQTTSettings) TLSConfig() (*tls.Config, error) {
+	if s.CAFile == "" && s.CertFile == "" && s.KeyFile == "" && !s.InsecureSkipVerify {
+		return nil, nil
+	}
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The user must explicitly choose to skip verification, e.g. for self-signed certificates
+		InsecureSkipVerify: s.InsecureSkipVerify, //nolint:gosec // see above
+	}
+	if s.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		bundle, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read CA bundle %s", s.CAFile)
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.Errorf("couldn't find any certificates in CA bundle %s", s.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	if s.CertFile != "" || s.KeyFile != "" {
+		if s.CertFile == "" || s.KeyFile == "" {
+			return nil, errors.New("client certificate and key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err, "couldn't load client certificate %s with key %s", s.CertFile, s.KeyFile,
+			)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// GetMQTTConfig makes MQTT client options with MQTT settings from environment variables.
 func GetMQTTConfig(brokerURL, clientID string) (c *mqtt.ClientOptions, err error) {
+	settings, err := GetMQTTSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't make MQTT settings")
+	}
+	return NewMQTTConfig(brokerURL, clientID, settings)
+}
+
+func NewMQTTConfig(brokerURL, clientID string, s MQTTSettings) (c *mqtt.ClientOptions, err error) {
 	c = mqtt.NewClientOptions()
 	if len(brokerURL) == 0 {
 		// If no broker is provided, return a zero-valued config
@@ -78,28 +271,33 @@ func GetMQTTConfig(brokerURL, clientID string) (c *mqtt.ClientOptions, err error
 	}
 	c.AddBroker(brokerURL)
 
-	c.SetCleanSession(true)
-	c.SetClientID(clientID)
-
-	c.SetConnectRetry(true)
-	connectTimeout, err := getMQTTConnectTimeout()
+	if s.Username != "" {
+		c.SetUsername(s.Username)
+	}
+	if s.Password != "" {
+		c.SetPassword(s.Password)
+	}
+	tlsConfig, err := s.TLSConfig()
 	if err != nil {
-		return nil, errors.Wrap(err, "couldn't make connect timeout config")
+		return nil, errors.Wrap(err, "couldn't make TLS config")
 	}
-	c.SetConnectTimeout(connectTimeout)
+	if tlsConfig != nil {
+		if !usesTLS(brokerURL) {
+			return nil, errors.Errorf(
+				"TLS settings were provided, but broker URL %s doesn't use TLS (e.g. mqtts://)", brokerURL,
+			)
+		}
+		c.SetTLSConfig(tlsConfig)
+	}
+
+	c.SetCleanSession(true)
+	c.SetClientID(clientID)
 
 	c.SetConnectRetry(true)
-	connectRetryInterval, err := getMQTTConnectRetryInterval()
-	if err != nil {
-		return nil, errors.Wrap(err, "couldn't make connect retry interval config")
-	}
-	c.SetConnectRetryInterval(connectRetryInterval)
+	c.SetConnectTimeout(s.ConnectTimeout)
+	c.SetConnectRetryInterval(s.ConnectRetryInterval)
 
 	c.SetAutoReconnect(true)
-	reconnectInterval, err := getMQTTReconnectInterval()
-	if err != nil {
-		return nil, errors.Wrap(err, "couldn't make reconnect interval config")
-	}
-	c.SetMaxReconnectInterval(reconnectInterval)
+	c.SetMaxReconnectInterval(s.ReconnectInterval)
 	return c, nil
 }
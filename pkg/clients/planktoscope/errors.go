@@ -0,0 +1,51 @@
+package planktoscope
+
+import (
+	"fmt"
+	"time"
+)
+
+// PublishError is returned when a command couldn't be published to the MQTT broker.
+type PublishError struct {
+	Topic string
+	Err   error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("couldn't publish command to %s: %s", e.Topic, e.Err)
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// NoResponseError is returned when the PlanktoScope didn't acknowledge a command within the
+// response timeout.
+type NoResponseError struct {
+	Subsystem string
+	Timeout   time.Duration
+}
+
+func (e *NoResponseError) Error() string {
+	return fmt.Sprintf("no response from %s within %s", e.Subsystem, e.Timeout)
+}
+
+// InterruptedError is returned when the PlanktoScope reports that it interrupted an operation
+// before the operation could finish.
+type InterruptedError struct {
+	Subsystem string
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("%s was interrupted", e.Subsystem)
+}
+
+// ConnectionLostError is returned when the connection to the MQTT broker is lost while waiting for
+// the PlanktoScope to finish an operation, so that the outcome of the operation is unknown.
+type ConnectionLostError struct {
+	Subsystem string
+}
+
+func (e *ConnectionLostError) Error() string {
+	return fmt.Sprintf("connection lost while waiting for %s to finish", e.Subsystem)
+}
@@ -0,0 +1,150 @@
+package planktoscope
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// EventType identifies the kind of change reported by an Event. Every event type is prefixed by
+// the name of the subsystem which the change belongs to.
+type EventType string
+
+const (
+	PumpStarted              EventType = "pump-started"
+	PumpDone                 EventType = "pump-done"
+	PumpInterrupted          EventType = "pump-interrupted"
+	PumpSettingsChanged      EventType = "pump-settings-changed"
+	CameraSettingsChanged    EventType = "camera-settings-changed"
+	ImagerStarted            EventType = "imager-started"
+	ImagerFrame              EventType = "imager-frame"
+	ImagerDone               EventType = "imager-done"
+	ImagerInterrupted        EventType = "imager-interrupted"
+	ImagerSettingsChanged    EventType = "imager-settings-changed"
+	SegmenterStarted         EventType = "segmenter-started"
+	SegmenterFrame           EventType = "segmenter-frame"
+	SegmenterObject          EventType = "segmenter-object"
+	SegmenterDone            EventType = "segmenter-done"
+	SegmenterInterrupted     EventType = "segmenter-interrupted"
+	SegmenterSettingsChanged EventType = "segmenter-settings-changed"
+	ConnectionChanged        EventType = "connection-changed"
+)
+
+// Subsystem returns the name of the subsystem which the event type belongs to.
+func (t EventType) Subsystem() string {
+	subsystem, _, _ := strings.Cut(string(t), "-")
+	return subsystem
+}
+
+// Event is a change to the state of a PlanktoScope, as reported by a message received over the
+// MQTT API (or, for ConnectionChanged events, by the MQTT client).
+type Event struct {
+	Type     EventType `json:"type"`
+	Topic    string    `json:"topic"`
+	Received time.Time `json:"received"`
+	// Payload is the parsed state resulting from the change, e.g. a Pump for PumpStarted events or
+	// an ImagerSettings for ImagerSettingsChanged events.
+	Payload interface{} `json:"payload"`
+	// Dropped is the number of events which were discarded for the subscriber immediately before
+	// this event, because the subscriber's buffer was full.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// EventFilter reports whether an event should be delivered to a subscriber.
+type EventFilter func(e Event) bool
+
+// EventTypes makes an EventFilter which accepts only events of the specified types.
+func EventTypes(types ...EventType) EventFilter {
+	return func(e Event) bool {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// EventSubsystems makes an EventFilter which accepts only events belonging to the specified
+// subsystems.
+func EventSubsystems(subsystems ...string) EventFilter {
+	return func(e Event) bool {
+		for _, subsystem := range subsystems {
+			if e.Type.Subsystem() == subsystem {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// EventBufferSize is the number of events which can be buffered for each subscriber.
+const EventBufferSize = 64
+
+type subscription struct {
+	events  chan Event
+	filters []EventFilter
+	dropped uint64
+}
+
+func (s *subscription) accepts(e Event) bool {
+	for _, filter := range s.filters {
+		if !filter(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe returns a channel which delivers events accepted by all of the filters, in the order
+// in which the client processed them, until the context is canceled; then the channel is closed.
+// Events are buffered for each subscriber (up to EventBufferSize events); if a subscriber falls
+// so far behind that its buffer is full, new events are discarded for that subscriber instead of
+// blocking the client, and the number of discarded events is reported in the Dropped field of the
+// next event delivered to that subscriber.
+func (c *Client) Subscribe(ctx context.Context, filters ...EventFilter) <-chan Event {
+	s := &subscription{
+		events:  make(chan Event, EventBufferSize),
+		filters: filters,
+	}
+	c.subscriptionsL.Lock()
+	c.subscriptions[s] = struct{}{}
+	c.subscriptionsL.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.subscriptionsL.Lock()
+		defer c.subscriptionsL.Unlock()
+
+		delete(c.subscriptions, s)
+		close(s.events)
+	}()
+	return s.events
+}
+
+// emitEvent delivers the event to all subscribers which accept it.
+func (c *Client) emitEvent(t EventType, topic string, received time.Time, payload interface{}) {
+	e := Event{
+		Type:     t,
+		Topic:    topic,
+		Received: received,
+		Payload:  payload,
+	}
+
+	c.subscriptionsL.Lock()
+	defer c.subscriptionsL.Unlock()
+
+	for s := range c.subscriptions {
+		if !s.accepts(e) {
+			continue
+		}
+		delivered := e
+		delivered.Dropped = s.dropped
+		select {
+		default:
+			s.dropped++
+		case s.events <- delivered:
+			s.dropped = 0
+		}
+	}
+}
@@ -2,9 +2,10 @@ package planktoscope
 
 import (
 	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 )
 
@@ -22,7 +23,9 @@ func (c *Client) updateImagerState(newState Imager) {
 	c.imagerB.BroadcastNext()
 }
 
-func (c *Client) handleImagerStatusUpdate(_ string, rawPayload []byte) error {
+func (c *Client) handleImagerStatusUpdate(
+	topic string, received time.Time, rawPayload []byte,
+) error {
 	type ImagerStatus struct {
 		Status   string  `json:"status"`
 		Duration float64 `json:"duration"`
@@ -33,25 +36,57 @@ func (c *Client) handleImagerStatusUpdate(_ string, rawPayload []byte) error {
 	}
 	newState := Imager{
 		StateKnown: true,
+		Start:      c.imager.Start,
 	}
+	var event EventType
 	switch status := payload.Status; status {
 	default:
-		// TODO: write the status to the imager state for display in the GUI
-		c.Logger.Infof("unknown status %s", status)
-		return nil
+		if !strings.HasPrefix(status, "Image ") {
+			// TODO: write the status to the imager state for display in the GUI
+			c.Logger.Infof("unknown status %s", status)
+			return nil
+		}
+		// The backend reports progress with statuses like "Image 3/100 has been imaged to ..."
+		progress, _, _ := strings.Cut(strings.TrimPrefix(status, "Image "), " ")
+		frameRaw, totalRaw, found := strings.Cut(progress, "/")
+		if !found {
+			return errors.Errorf("couldn't parse status %s for imager progress", status)
+		}
+		const (
+			base  = 10
+			width = 64 // bits
+		)
+		var err error
+		if newState.CurrentFrame, err = strconv.ParseUint(frameRaw, base, width); err != nil {
+			return errors.Wrapf(err, "couldn't parse status %s for imager progress", status)
+		}
+		if newState.TotalFrames, err = strconv.ParseUint(totalRaw, base, width); err != nil {
+			return errors.Wrapf(err, "couldn't parse status %s for imager progress", status)
+		}
+		event = ImagerFrame
+		newState.Imaging = true
 	case "Camera settings updated":
 		return nil
 	case startedStatus:
+		event = ImagerStarted
 		newState.Imaging = true
-		newState.Start = time.Now()
-	case "Interrupted":
+		newState.Start = received
+	case interruptedStatus:
+		event = ImagerInterrupted
 		newState.Imaging = false
+		newState.Interrupted = true
+		newState.CurrentFrame = c.imager.CurrentFrame
+		newState.TotalFrames = c.imager.TotalFrames
 	case doneStatus:
+		event = ImagerDone
 		newState.Imaging = false
+		newState.CurrentFrame = c.imager.CurrentFrame
+		newState.TotalFrames = c.imager.TotalFrames
 	}
 
 	// Commit changes
 	c.updateImagerState(newState)
+	c.emitEvent(event, topic, received, newState)
 	c.Logger.Debugf("%s: %+v", c.Config.URL, newState)
 	return nil
 }
@@ -69,7 +104,9 @@ const (
 	stopCommand  = "stop"
 )
 
-func (c *Client) handleImagerImagingUpdate(_ string, rawPayload []byte) error {
+func (c *Client) handleImagerImagingUpdate(
+	topic string, received time.Time, rawPayload []byte,
+) error {
 	type ImageCommand struct {
 		Action     string  `json:"action"`
 		Direction  string  `json:"pump_direction,omitempty"`
@@ -105,12 +142,13 @@ func (c *Client) handleImagerImagingUpdate(_ string, rawPayload []byte) error {
 
 		// Commit changes
 		c.updateImagerSettings(newSettings)
+		c.emitEvent(ImagerSettingsChanged, topic, received, newSettings)
 		c.Logger.Debugf("%s: %+v", c.Config.URL, newSettings)
 	}
 	return nil
 }
 
-func (c *Client) handleImagerUpdate(topic string, rawPayload []byte) error {
+func (c *Client) handleImagerUpdate(topic string, received time.Time, rawPayload []byte) error {
 	type ImagerBaseCommand struct {
 		Action string `json:"action"`
 	}
@@ -131,18 +169,18 @@ func (c *Client) handleImagerUpdate(topic string, rawPayload []byte) error {
 		// No settings to update
 		break
 	case "settings":
-		if err := c.handleCameraSettingsUpdate(topic, rawPayload); err != nil {
+		if err := c.handleCameraSettingsUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrap(err, "invalid camera settings command")
 		}
 	case imageCommand:
-		if err := c.handleImagerImagingUpdate(topic, rawPayload); err != nil {
+		if err := c.handleImagerImagingUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrap(err, "invalid imager config update command")
 		}
 	}
 	return nil
 }
 
-func (c *Client) handleImagerMessage(topic string, rawPayload []byte) error {
+func (c *Client) handleImagerMessage(topic string, received time.Time, rawPayload []byte) error {
 	broker := c.Config.URL
 
 	switch topic {
@@ -153,11 +191,11 @@ func (c *Client) handleImagerMessage(topic string, rawPayload []byte) error {
 		}
 		c.Logger.Infof("%s/%s: %v", broker, topic, payload)
 	case "status/imager":
-		if err := c.handleImagerStatusUpdate(topic, rawPayload); err != nil {
+		if err := c.handleImagerStatusUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrapf(err, "%s/%s: invalid payload %s", broker, topic, rawPayload)
 		}
 	case "imager/image":
-		if err := c.handleImagerUpdate(topic, rawPayload); err != nil {
+		if err := c.handleImagerUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrapf(err, "%s/%s: invalid payload %s", broker, topic, rawPayload)
 		}
 	}
@@ -167,7 +205,7 @@ func (c *Client) handleImagerMessage(topic string, rawPayload []byte) error {
 
 // Send Commands
 
-func (c *Client) StopImaging() (mqtt.Token, error) {
+func (c *Client) StopImaging() (Token, error) {
 	command := struct {
 		Action string `json:"action"`
 	}{
@@ -177,13 +215,13 @@ func (c *Client) StopImaging() (mqtt.Token, error) {
 	if err != nil {
 		return nil, err
 	}
-	token := c.MQTT.Publish("imager/image", mqttAtLeastOnce, false, marshaled)
+	token := c.Transport.Publish("imager/image", mqttAtLeastOnce, false, marshaled)
 	return token, nil
 }
 
 func (c *Client) StartImaging(
 	forward bool, stepVolume, stepDelay float64, steps uint64,
-) (mqtt.Token, error) {
+) (Token, error) {
 	command := struct {
 		Action     string  `json:"action"`
 		Direction  string  `json:"pump_direction"`
@@ -209,11 +247,13 @@ func (c *Client) StartImaging(
 	c.stateL.Lock()
 	defer c.stateL.Unlock()
 
-	c.imagerSettings.Forward = forward
-	c.imagerSettings.StepVolume = stepVolume
-	c.imagerSettings.StepDelay = stepDelay
-	c.imagerSettings.Steps = steps
+	if !c.dryRun {
+		c.imagerSettings.Forward = forward
+		c.imagerSettings.StepVolume = stepVolume
+		c.imagerSettings.StepDelay = stepDelay
+		c.imagerSettings.Steps = steps
+	}
 
-	token := c.MQTT.Publish("imager/image", mqttExactlyOnce, false, marshaled)
+	token := c.Transport.Publish("imager/image", mqttExactlyOnce, false, marshaled)
 	return token, nil
 }
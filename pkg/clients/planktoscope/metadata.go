@@ -4,15 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
-
-	"github.com/eclipse/paho.mqtt.golang"
 )
 
 // Send Commands
 
 func (c *Client) SetMetadata(
 	sampleProjectID, sampleID string, acquisitionTime time.Time,
-) (mqtt.Token, error) {
+) (Token, error) {
 	type Metadata struct {
 		SampleProjectID      string `json:"sample_project"`
 		SampleID             string `json:"sample_id"`
@@ -38,6 +36,6 @@ func (c *Client) SetMetadata(
 		return nil, err
 	}
 
-	token := c.MQTT.Publish("imager/image", mqttExactlyOnce, false, marshaled)
+	token := c.Transport.Publish("imager/image", mqttExactlyOnce, false, marshaled)
 	return token, nil
 }
@@ -5,29 +5,40 @@ import (
 )
 
 type Planktoscope struct {
-	Pump              Pump
-	PumpSettings      PumpSettings
-	CameraSettings    CameraSettings
-	Imager            Imager
-	ImagerSettings    ImagerSettings
-	Segmenter         Segmenter
-	SegmenterSettings SegmenterSettings
+	Pump              Pump              `json:"pump"`
+	PumpSettings      PumpSettings      `json:"pump_settings"`
+	CameraSettings    CameraSettings    `json:"camera_settings"`
+	Imager            Imager            `json:"imager"`
+	ImagerSettings    ImagerSettings    `json:"imager_settings"`
+	Segmenter         Segmenter         `json:"segmenter"`
+	SegmenterSettings SegmenterSettings `json:"segmenter_settings"`
+	Connection        Connection        `json:"connection"`
+}
+
+// Connection
+
+type Connection struct {
+	Connected    bool      `json:"connected"`
+	Reconnecting bool      `json:"reconnecting"`
+	LostSince    time.Time `json:"lost_since"`
+	LastError    string    `json:"last_error"`
 }
 
 // Pump
 
 type Pump struct {
-	StateKnown bool
-	Pumping    bool
-	Start      time.Time
-	Duration   time.Duration
-	Deadline   time.Time
+	StateKnown  bool          `json:"state_known"`
+	Pumping     bool          `json:"pumping"`
+	Interrupted bool          `json:"interrupted"`
+	Start       time.Time     `json:"start"`
+	Duration    time.Duration `json:"duration"`
+	Deadline    time.Time     `json:"deadline"`
 }
 
 type PumpSettings struct {
-	Forward  bool
-	Volume   float64
-	Flowrate float64
+	Forward  bool    `json:"forward"`
+	Volume   float64 `json:"volume"`
+	Flowrate float64 `json:"flowrate"`
 }
 
 func DefaultPumpSettings() PumpSettings {
@@ -43,12 +54,12 @@ func DefaultPumpSettings() PumpSettings {
 // Camera
 
 type CameraSettings struct {
-	StateKnown           bool
-	ISO                  uint64
-	ShutterSpeed         uint64
-	AutoWhiteBalance     bool
-	WhiteBalanceRedGain  float64
-	WhiteBalanceBlueGain float64
+	StateKnown           bool    `json:"state_known"`
+	ISO                  uint64  `json:"iso"`
+	ShutterSpeed         uint64  `json:"shutter_speed"`
+	AutoWhiteBalance     bool    `json:"auto_white_balance"`
+	WhiteBalanceRedGain  float64 `json:"white_balance_red_gain"`
+	WhiteBalanceBlueGain float64 `json:"white_balance_blue_gain"`
 }
 
 func DefaultCameraSettings() CameraSettings {
@@ -68,16 +79,19 @@ func DefaultCameraSettings() CameraSettings {
 // Imager
 
 type Imager struct {
-	StateKnown bool
-	Imaging    bool
-	Start      time.Time
+	StateKnown   bool      `json:"state_known"`
+	Imaging      bool      `json:"imaging"`
+	Interrupted  bool      `json:"interrupted"`
+	CurrentFrame uint64    `json:"current_frame"`
+	TotalFrames  uint64    `json:"total_frames"`
+	Start        time.Time `json:"start"`
 }
 
 type ImagerSettings struct {
-	Forward    bool
-	StepVolume float64
-	StepDelay  float64
-	Steps      uint64
+	Forward    bool    `json:"forward"`
+	StepVolume float64 `json:"step_volume"`
+	StepDelay  float64 `json:"step_delay"`
+	Steps      uint64  `json:"steps"`
 }
 
 func DefaultImagerSettings() ImagerSettings {
@@ -95,20 +109,21 @@ func DefaultImagerSettings() ImagerSettings {
 // Segmenter
 
 type Segmenter struct {
-	StateKnown   bool
-	Segmenting   bool
-	CurrentFrame uint64
-	LastObject   uint64
-	Start        time.Time
+	StateKnown   bool      `json:"state_known"`
+	Segmenting   bool      `json:"segmenting"`
+	Interrupted  bool      `json:"interrupted"`
+	CurrentFrame uint64    `json:"current_frame"`
+	LastObject   uint64    `json:"last_object"`
+	Start        time.Time `json:"start"`
 }
 
 type SegmenterSettings struct {
-	Paths             []string
-	ProcessingID      uint64
-	Recurse           bool
-	ForceReprocessing bool
-	KeepObjects       bool
-	ExportEcoTaxa     bool
+	Paths             []string `json:"paths"`
+	ProcessingID      uint64   `json:"processing_id"`
+	Recurse           bool     `json:"recurse"`
+	ForceReprocessing bool     `json:"force_reprocessing"`
+	KeepObjects       bool     `json:"keep_objects"`
+	ExportEcoTaxa     bool     `json:"export_ecotaxa"`
 }
 
 func DefaultSegmenterSettings() SegmenterSettings {
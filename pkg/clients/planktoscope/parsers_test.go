@@ -0,0 +1,153 @@
+package planktoscope
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// parserTest describes a message parser to test against a corpus of messages in
+// testdata/<protocol>/<name>.ndjson, in the newline-delimited JSON format written by Recorder. The
+// state produced by each message is compared against testdata/<protocol>/<name>.golden.json.
+type parserTest struct {
+	name   string
+	handle func(c *Client, topic string, received time.Time, rawPayload []byte) error
+	state  func(p Planktoscope) interface{}
+}
+
+var parserTests = []parserTest{
+	{
+		name:   "pump-status",
+		handle: (*Client).handlePumpStatusUpdate,
+		state:  func(p Planktoscope) interface{} { return p.Pump },
+	},
+	{
+		name:   "pump-actuator",
+		handle: (*Client).handlePumpActuatorUpdate,
+		state:  func(p Planktoscope) interface{} { return p.PumpSettings },
+	},
+	{
+		name:   "camera-settings",
+		handle: (*Client).handleCameraSettingsUpdate,
+		state:  func(p Planktoscope) interface{} { return p.CameraSettings },
+	},
+	{
+		name:   "imager-status",
+		handle: (*Client).handleImagerStatusUpdate,
+		state:  func(p Planktoscope) interface{} { return p.Imager },
+	},
+	{
+		name:   "imager-imaging",
+		handle: (*Client).handleImagerImagingUpdate,
+		state:  func(p Planktoscope) interface{} { return p.ImagerSettings },
+	},
+	{
+		name:   "segmenter-status",
+		handle: (*Client).handleSegmenterStatusUpdate,
+		state:  func(p Planktoscope) interface{} { return p.Segmenter },
+	},
+	{
+		name:   "segmenter-object",
+		handle: (*Client).handleSegmenterStatusObjectUpdate,
+		state:  func(p Planktoscope) interface{} { return p.Segmenter },
+	},
+	{
+		name:   "segmenter-segmenting",
+		handle: (*Client).handleSegmenterSegmentingUpdate,
+		state:  func(p Planktoscope) interface{} { return p.SegmenterSettings },
+	},
+}
+
+// parserResult is the result of parsing one message in a corpus.
+type parserResult struct {
+	Topic   string      `json:"topic"`
+	Payload string      `json:"payload"`
+	Error   string      `json:"error,omitempty"`
+	State   interface{} `json:"state"`
+}
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	logger := log.New("test")
+	logger.SetLevel(log.OFF)
+	client, err := NewClient(Config{}, logger)
+	if err != nil {
+		t.Fatalf("couldn't make client: %s", err)
+	}
+	return client
+}
+
+func readCorpus(t *testing.T, path string) []RawMessage {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("couldn't open corpus: %s", err)
+	}
+	defer file.Close()
+
+	reader := NewRecordingReader(file)
+	var messages []RawMessage
+	for {
+		m, err := reader.Next()
+		if err == io.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatalf("couldn't read corpus: %s", err)
+		}
+		messages = append(messages, m)
+	}
+}
+
+func TestParsers(t *testing.T) {
+	for _, test := range parserTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			corpusPath := filepath.Join("testdata", Protocol, test.name+".ndjson")
+			goldenPath := filepath.Join("testdata", Protocol, test.name+".golden.json")
+
+			// Messages are parsed in order by the same client, because some parsers depend on the
+			// state produced by previous messages
+			client := newTestClient(t)
+			var results []parserResult
+			for _, m := range readCorpus(t, corpusPath) {
+				result := parserResult{Topic: m.Topic, Payload: m.Payload}
+				if err := test.handle(client, m.Topic, m.Received, []byte(m.Payload)); err != nil {
+					result.Error = err.Error()
+				}
+				result.State = test.state(client.GetState())
+				results = append(results, result)
+			}
+			actual, err := json.MarshalIndent(results, "", "  ")
+			if err != nil {
+				t.Fatalf("couldn't marshal results: %s", err)
+			}
+			actual = append(actual, '\n')
+
+			if *update {
+				if err = os.WriteFile(goldenPath, actual, 0o644); err != nil {
+					t.Fatalf("couldn't update golden file: %s", err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("couldn't read golden file (run with -update to create it): %s", err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf(
+					"results differ from %s (run with -update to accept them):\n%s", goldenPath, actual,
+				)
+			}
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 )
 
@@ -24,11 +23,12 @@ func (c *Client) updatePumpState(newState Pump) {
 }
 
 const (
-	startedStatus = "Started"
-	doneStatus    = "Done"
+	startedStatus     = "Started"
+	interruptedStatus = "Interrupted"
+	doneStatus        = "Done"
 )
 
-func (c *Client) handlePumpStatusUpdate(_ string, rawPayload []byte) error {
+func (c *Client) handlePumpStatusUpdate(topic string, received time.Time, rawPayload []byte) error {
 	type PumpStatus struct {
 		Status   string  `json:"status"`
 		Duration float64 `json:"duration"`
@@ -37,21 +37,29 @@ func (c *Client) handlePumpStatusUpdate(_ string, rawPayload []byte) error {
 	if err := json.Unmarshal(rawPayload, &payload); err != nil {
 		return errors.Wrapf(err, "unparseable payload")
 	}
+	// The start time is only reset when the pump starts, so that a final status can be matched
+	// with the operation which it ends
 	newState := Pump{
 		StateKnown: true,
-		Start:      time.Now(),
+		Start:      c.pump.Start,
 	}
+	var event EventType
 	switch status := payload.Status; status {
 	default:
 		// TODO: write the status to the imager state for display in the GUI
 		return errors.Errorf("unknown status %s", status)
 	case startedStatus:
+		event = PumpStarted
 		newState.Pumping = true
+		newState.Start = received
 		newState.Duration = time.Duration(payload.Duration) * time.Second
-	case "Interrupted":
+	case interruptedStatus:
+		event = PumpInterrupted
 		newState.Pumping = false
+		newState.Interrupted = true
 		newState.Duration = 0
 	case doneStatus:
+		event = PumpDone
 		newState.Pumping = false
 		newState.Duration = 0
 	}
@@ -59,6 +67,7 @@ func (c *Client) handlePumpStatusUpdate(_ string, rawPayload []byte) error {
 
 	// Commit changes
 	c.updatePumpState(newState)
+	c.emitEvent(event, topic, received, newState)
 	c.Logger.Debugf("%s: %+v", c.Config.URL, newState)
 	return nil
 }
@@ -89,7 +98,9 @@ const (
 	backwardDirection = "BACKWARD"
 )
 
-func (c *Client) handlePumpActuatorUpdate(_ string, rawPayload []byte) error {
+func (c *Client) handlePumpActuatorUpdate(
+	topic string, received time.Time, rawPayload []byte,
+) error {
 	type PumpCommand struct {
 		Action    string `json:"action"`
 		Direction string `json:"direction,omitempty"`
@@ -135,12 +146,13 @@ func (c *Client) handlePumpActuatorUpdate(_ string, rawPayload []byte) error {
 
 		// Commit changes
 		c.updatePumpSettings(newSettings)
+		c.emitEvent(PumpSettingsChanged, topic, received, newSettings)
 		c.Logger.Debugf("%s: %+v", c.Config.URL, newSettings)
 	}
 	return nil
 }
 
-func (c *Client) handlePumpMessage(topic string, rawPayload []byte) error {
+func (c *Client) handlePumpMessage(topic string, received time.Time, rawPayload []byte) error {
 	broker := c.Config.URL
 
 	switch topic {
@@ -151,11 +163,11 @@ func (c *Client) handlePumpMessage(topic string, rawPayload []byte) error {
 		}
 		c.Logger.Infof("%s/%s: %v", broker, topic, payload)
 	case "status/pump":
-		if err := c.handlePumpStatusUpdate(topic, rawPayload); err != nil {
+		if err := c.handlePumpStatusUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrapf(err, "%s/%s: invalid payload %s", broker, topic, rawPayload)
 		}
 	case "actuator/pump":
-		if err := c.handlePumpActuatorUpdate(topic, rawPayload); err != nil {
+		if err := c.handlePumpActuatorUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrapf(err, "%s/%s: invalid payload %s", broker, topic, rawPayload)
 		}
 	}
@@ -165,7 +177,7 @@ func (c *Client) handlePumpMessage(topic string, rawPayload []byte) error {
 
 // Send Commands
 
-func (c *Client) StopPump() (mqtt.Token, error) {
+func (c *Client) StopPump() (Token, error) {
 	command := struct {
 		Action string `json:"action"`
 	}{
@@ -175,11 +187,11 @@ func (c *Client) StopPump() (mqtt.Token, error) {
 	if err != nil {
 		return nil, err
 	}
-	token := c.MQTT.Publish("actuator/pump", mqttAtLeastOnce, false, marshaled)
+	token := c.Transport.Publish("actuator/pump", mqttAtLeastOnce, false, marshaled)
 	return token, nil
 }
 
-func (c *Client) StartPump(forward bool, volume, flowrate float64) (mqtt.Token, error) {
+func (c *Client) StartPump(forward bool, volume, flowrate float64) (Token, error) {
 	command := struct {
 		Action    string  `json:"action"`
 		Direction string  `json:"direction"`
@@ -203,10 +215,12 @@ func (c *Client) StartPump(forward bool, volume, flowrate float64) (mqtt.Token,
 	c.stateL.Lock()
 	defer c.stateL.Unlock()
 
-	c.pumpSettings.Forward = forward
-	c.pumpSettings.Volume = volume
-	c.pumpSettings.Flowrate = flowrate
+	if !c.dryRun {
+		c.pumpSettings.Forward = forward
+		c.pumpSettings.Volume = volume
+		c.pumpSettings.Flowrate = flowrate
+	}
 
-	token := c.MQTT.Publish("actuator/pump", mqttExactlyOnce, false, marshaled)
+	token := c.Transport.Publish("actuator/pump", mqttExactlyOnce, false, marshaled)
 	return token, nil
 }
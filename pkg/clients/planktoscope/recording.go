@@ -0,0 +1,196 @@
+package planktoscope
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RawMessage is a message received over the MQTT API, before it's parsed by the client.
+type RawMessage struct {
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	Received time.Time `json:"received"`
+	Payload  string    `json:"payload"`
+}
+
+// MessageHandler is called with every message received by the client, before the client
+// processes the message.
+type MessageHandler func(m RawMessage)
+
+// AddMessageHandler registers a handler to be called with every message received by the client.
+// Handlers should be added before the client connects, so that they don't miss any messages.
+func (c *Client) AddMessageHandler(h MessageHandler) {
+	c.messageHandlersL.Lock()
+	defer c.messageHandlersL.Unlock()
+
+	c.messageHandlers = append(c.messageHandlers, h)
+}
+
+func (c *Client) handleRawMessage(m RawMessage) {
+	c.messageHandlersL.RLock()
+	defer c.messageHandlersL.RUnlock()
+
+	for _, h := range c.messageHandlers {
+		h(m)
+	}
+}
+
+// Recorder writes messages to a newline-delimited JSON file, rotating the file once it exceeds a
+// maximum size or age. Rotated files are renamed with the time of rotation inserted before the
+// file extension, so that the file at the recorder's path is always the newest one.
+type Recorder struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	l       *sync.Mutex
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+// NewRecorder makes a Recorder which writes to the file at the path, appending to any existing
+// file. If maxSize or maxAge is zero, files aren't rotated based on size or age, respectively.
+func NewRecorder(path string, maxSize int64, maxAge time.Duration) (*Recorder, error) {
+	r := &Recorder{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		l:       &sync.Mutex{},
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	const perm = 0o644
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open recording file %s", r.path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "couldn't check recording file %s", r.path)
+	}
+	r.file = file
+	r.size = info.Size()
+	r.created = time.Now()
+	return nil
+}
+
+// rotatedPath returns the path to which the current file is moved when it's rotated.
+func (r *Recorder) rotatedPath(rotated time.Time) string {
+	ext := filepath.Ext(r.path)
+	return fmt.Sprintf(
+		"%s-%s%s", strings.TrimSuffix(r.path, ext), rotated.UTC().Format("20060102T150405.000Z"), ext,
+	)
+}
+
+func (r *Recorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return errors.Wrapf(err, "couldn't close recording file %s", r.path)
+	}
+	rotatedPath := r.rotatedPath(time.Now())
+	if err := os.Rename(r.path, rotatedPath); err != nil {
+		return errors.Wrapf(err, "couldn't move recording file %s to %s", r.path, rotatedPath)
+	}
+	return r.open()
+}
+
+func (r *Recorder) needsRotation(nextSize int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+int64(nextSize) > r.maxSize {
+		return true
+	}
+	return r.maxAge > 0 && time.Since(r.created) > r.maxAge
+}
+
+// Record appends the message to the recording file, rotating the file first if necessary.
+func (r *Recorder) Record(m RawMessage) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "couldn't serialize message")
+	}
+	line = append(line, '\n')
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.needsRotation(len(line)) {
+		if err = r.rotate(); err != nil {
+			return errors.Wrap(err, "couldn't rotate recording file")
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return errors.Wrapf(err, "couldn't write to recording file %s", r.path)
+}
+
+// Close closes the recording file.
+func (r *Recorder) Close() error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	return r.file.Close()
+}
+
+// RecordingReader reads messages from a newline-delimited JSON file written by a Recorder.
+type RecordingReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewRecordingReader makes a RecordingReader which reads from r.
+func NewRecordingReader(r io.Reader) *RecordingReader {
+	const (
+		initialBufferSize = 64 * 1024        // bytes
+		maxLineSize       = 16 * 1024 * 1024 // bytes
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, initialBufferSize), maxLineSize)
+	return &RecordingReader{
+		scanner: scanner,
+	}
+}
+
+// Next returns the next recorded message, or io.EOF if no messages remain.
+func (r *RecordingReader) Next() (m RawMessage, err error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err = json.Unmarshal(line, &m); err != nil {
+			return RawMessage{}, errors.Wrapf(err, "couldn't parse recorded message on line %d", r.line)
+		}
+		return m, nil
+	}
+	if err = r.scanner.Err(); err != nil {
+		return RawMessage{}, errors.Wrap(err, "couldn't read recorded messages")
+	}
+	return RawMessage{}, io.EOF
+}
+
+// Replay processes a recorded message as if the client had just received it over the MQTT API,
+// except that the message's recorded receive time is used instead of the current time. All state
+// updates and events resulting from the message are complete by the time Replay returns.
+func (c *Client) Replay(m RawMessage) {
+	c.processMessage(m)
+}
@@ -6,7 +6,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 )
 
@@ -24,7 +23,9 @@ func (c *Client) updateSegmenterState(newState Segmenter) {
 	c.segmenterB.BroadcastNext()
 }
 
-func (c *Client) handleSegmenterStatusUpdate(_ string, rawPayload []byte) (err error) {
+func (c *Client) handleSegmenterStatusUpdate(
+	topic string, received time.Time, rawPayload []byte,
+) (err error) {
 	type SegmenterStatus struct {
 		Status string `json:"status"`
 	}
@@ -36,6 +37,7 @@ func (c *Client) handleSegmenterStatusUpdate(_ string, rawPayload []byte) (err e
 		StateKnown: true,
 		Start:      c.segmenter.Start,
 	}
+	var event EventType
 	switch status := payload.Status; status {
 	default:
 		if !strings.HasPrefix(status, "Segmenting image") {
@@ -58,17 +60,26 @@ func (c *Client) handleSegmenterStatusUpdate(_ string, rawPayload []byte) (err e
 		if newState.CurrentFrame, err = strconv.ParseUint(frameRaw, base, width); err != nil {
 			return errors.Wrapf(err, "couldn't parse status %s for segmenter progress", status)
 		}
+		event = SegmenterFrame
 		newState.Segmenting = true
 		newState.LastObject = c.segmenter.LastObject
 	case startedStatus:
+		event = SegmenterStarted
 		newState.Segmenting = true
-		newState.Start = time.Now()
+		newState.Start = received
 	case "Calculating flat":
 		newState.Segmenting = true
 		newState.CurrentFrame = c.segmenter.CurrentFrame
 		newState.LastObject = c.segmenter.LastObject
 		return nil
+	case interruptedStatus:
+		event = SegmenterInterrupted
+		newState.Segmenting = false
+		newState.Interrupted = true
+		newState.CurrentFrame = c.segmenter.CurrentFrame
+		newState.LastObject = c.segmenter.LastObject
 	case doneStatus:
+		event = SegmenterDone
 		newState.Segmenting = false
 		newState.CurrentFrame = c.segmenter.CurrentFrame
 		newState.LastObject = c.segmenter.LastObject
@@ -76,11 +87,14 @@ func (c *Client) handleSegmenterStatusUpdate(_ string, rawPayload []byte) (err e
 
 	// Commit changes
 	c.updateSegmenterState(newState)
+	c.emitEvent(event, topic, received, newState)
 	c.Logger.Debugf("%s: %+v", c.Config.URL, newState)
 	return nil
 }
 
-func (c *Client) handleSegmenterStatusObjectUpdate(_ string, rawPayload []byte) error {
+func (c *Client) handleSegmenterStatusObjectUpdate(
+	topic string, received time.Time, rawPayload []byte,
+) error {
 	type SegmenterStatusObject struct {
 		ID string `json:"object_id"`
 	}
@@ -106,6 +120,7 @@ func (c *Client) handleSegmenterStatusObjectUpdate(_ string, rawPayload []byte)
 
 	// Commit changes
 	c.updateSegmenterState(newState)
+	c.emitEvent(SegmenterObject, topic, received, newState)
 	c.Logger.Debugf("%s: %+v", c.Config.URL, newState)
 	return nil
 }
@@ -122,7 +137,9 @@ const (
 	segmentCommand = "segment"
 )
 
-func (c *Client) handleSegmenterSegmentingUpdate(_ string, rawPayload []byte) error {
+func (c *Client) handleSegmenterSegmentingUpdate(
+	topic string, received time.Time, rawPayload []byte,
+) error {
 	type SegmentSettings struct {
 		EcoTaxa   bool   `json:"ecotaxa,omitempty"`
 		Force     bool   `json:"force,omitempty"`
@@ -154,11 +171,12 @@ func (c *Client) handleSegmenterSegmentingUpdate(_ string, rawPayload []byte) er
 
 	// Commit changes
 	c.updateSegmenterSettings(newSettings)
+	c.emitEvent(SegmenterSettingsChanged, topic, received, newSettings)
 	c.Logger.Debugf("%s: %+v", c.Config.URL, newSettings)
 	return nil
 }
 
-func (c *Client) handleSegmenterUpdate(topic string, rawPayload []byte) error {
+func (c *Client) handleSegmenterUpdate(topic string, received time.Time, rawPayload []byte) error {
 	type SegmenterBaseCommand struct {
 		Action string `json:"action"`
 	}
@@ -175,15 +193,18 @@ func (c *Client) handleSegmenterUpdate(topic string, rawPayload []byte) error {
 			return nil
 		}
 		c.Logger.Infof("%s/%s: %v", broker, topic, payload)
+	case stopCommand:
+		// No settings to update
+		break
 	case segmentCommand:
-		if err := c.handleSegmenterSegmentingUpdate(topic, rawPayload); err != nil {
+		if err := c.handleSegmenterSegmentingUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrap(err, "invalid segmenter config update command")
 		}
 	}
 	return nil
 }
 
-func (c *Client) handleSegmenterMessage(topic string, rawPayload []byte) error {
+func (c *Client) handleSegmenterMessage(topic string, received time.Time, rawPayload []byte) error {
 	broker := c.Config.URL
 
 	switch topic {
@@ -194,15 +215,15 @@ func (c *Client) handleSegmenterMessage(topic string, rawPayload []byte) error {
 		}
 		c.Logger.Infof("%s/%s: %v", broker, topic, payload)
 	case "segmenter/segment":
-		if err := c.handleSegmenterUpdate(topic, rawPayload); err != nil {
+		if err := c.handleSegmenterUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrapf(err, "%s/%s: invalid payload %s", broker, topic, rawPayload)
 		}
 	case "status/segmenter":
-		if err := c.handleSegmenterStatusUpdate(topic, rawPayload); err != nil {
+		if err := c.handleSegmenterStatusUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrapf(err, "%s/%s: invalid payload %s", broker, topic, rawPayload)
 		}
 	case "status/segmenter/object_id":
-		if err := c.handleSegmenterStatusObjectUpdate(topic, rawPayload); err != nil {
+		if err := c.handleSegmenterStatusObjectUpdate(topic, received, rawPayload); err != nil {
 			return errors.Wrapf(err, "%s/%s: invalid payload %s", broker, topic, rawPayload)
 		}
 	case "status/segmenter/metric":
@@ -214,10 +235,24 @@ func (c *Client) handleSegmenterMessage(topic string, rawPayload []byte) error {
 
 // Send Commands
 
+func (c *Client) StopSegmenting() (Token, error) {
+	command := struct {
+		Action string `json:"action"`
+	}{
+		Action: stopCommand,
+	}
+	marshaled, err := json.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	token := c.Transport.Publish("segmenter/segment", mqttAtLeastOnce, false, marshaled)
+	return token, nil
+}
+
 func (c *Client) StartSegmenting(
 	paths []string, processingID uint64,
 	recurse bool, forceReprocessing bool, keepObjects bool, exportEcoTaxa bool,
-) (mqtt.Token, error) {
+) (Token, error) {
 	type CommandSettings struct {
 		ExportEcoTaxa     bool   `json:"ecotaxa"`
 		ForceReprocessing bool   `json:"force"`
@@ -248,13 +283,15 @@ func (c *Client) StartSegmenting(
 	c.stateL.Lock()
 	defer c.stateL.Unlock()
 
-	c.segmenterSettings.Paths = paths
-	c.segmenterSettings.ProcessingID = processingID
-	c.segmenterSettings.Recurse = recurse
-	c.segmenterSettings.ForceReprocessing = forceReprocessing
-	c.segmenterSettings.KeepObjects = keepObjects
-	c.segmenterSettings.ExportEcoTaxa = exportEcoTaxa
+	if !c.dryRun {
+		c.segmenterSettings.Paths = paths
+		c.segmenterSettings.ProcessingID = processingID
+		c.segmenterSettings.Recurse = recurse
+		c.segmenterSettings.ForceReprocessing = forceReprocessing
+		c.segmenterSettings.KeepObjects = keepObjects
+		c.segmenterSettings.ExportEcoTaxa = exportEcoTaxa
+	}
 
-	token := c.MQTT.Publish("segmenter/segment", mqttExactlyOnce, false, marshaled)
+	token := c.Transport.Publish("segmenter/segment", mqttExactlyOnce, false, marshaled)
 	return token, nil
 }
@@ -0,0 +1,68 @@
+package planktoscope
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MatchTopic reports whether the MQTT topic matches the topic filter, which may contain the
+// single-level wildcard "+" and the multi-level wildcard "#".
+func MatchTopic(filter, topic string) bool {
+	// Wildcards at the first level don't match topics reserved by the broker, per the MQTT spec
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, filterLevel := range filterLevels {
+		if filterLevel == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if filterLevel != "+" && filterLevel != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// ValidateTopic checks whether the MQTT topic can be published to: it must be non-empty and must
+// not contain wildcards.
+func ValidateTopic(topic string) error {
+	if topic == "" {
+		return errors.New("topic must not be empty")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return errors.Errorf("topic %s must not contain the wildcards + or #", topic)
+	}
+	return nil
+}
+
+// ValidateTopicFilter checks whether the MQTT topic filter can be subscribed to: it must be
+// non-empty, the single-level wildcard "+" must occupy an entire level, and the multi-level
+// wildcard "#" must occupy the entire last level.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return errors.New("topic filter must not be empty")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i == len(levels)-1 {
+			continue
+		}
+		if strings.Contains(level, "#") {
+			return errors.Errorf(
+				"topic filter %s may only use the wildcard # as its entire last level", filter,
+			)
+		}
+		if level != "+" && strings.Contains(level, "+") {
+			return errors.Errorf(
+				"topic filter %s may only use the wildcard + as an entire level", filter,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package planktoscope
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	for _, test := range []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{filter: "status/pump", topic: "status/pump", expected: true},
+		{filter: "status/pump", topic: "status/imager"},
+		{filter: "status/pump", topic: "status/pump/extra"},
+		{filter: "status/pump/extra", topic: "status/pump"},
+		{filter: "status", topic: "status/pump"},
+
+		// Single-level wildcards
+		{filter: "status/+", topic: "status/pump", expected: true},
+		{filter: "status/+", topic: "status/segmenter/object_id"},
+		{filter: "status/+", topic: "status"},
+		{filter: "status/+", topic: "status/", expected: true},
+		{filter: "+/pump", topic: "actuator/pump", expected: true},
+		{filter: "+/+", topic: "status/pump", expected: true},
+		{filter: "+", topic: "status", expected: true},
+		{filter: "+", topic: "/status"},
+		{filter: "+/+", topic: "/status", expected: true},
+
+		// Multi-level wildcards
+		{filter: "#", topic: "status/segmenter/object_id", expected: true},
+		{filter: "#", topic: "/", expected: true},
+		{filter: "status/#", topic: "status/segmenter/object_id", expected: true},
+		{filter: "status/#", topic: "status", expected: true},
+		{filter: "status/#", topic: "actuator/pump"},
+		{filter: "status/+/#", topic: "status/segmenter/object_id", expected: true},
+		{filter: "status/+/#", topic: "status"},
+
+		// Topics reserved by the broker only match filters which start with $
+		{filter: "#", topic: "$SYS/broker/uptime"},
+		{filter: "+/broker/uptime", topic: "$SYS/broker/uptime"},
+		{filter: "$SYS/#", topic: "$SYS/broker/uptime", expected: true},
+		{filter: "$SYS/+/uptime", topic: "$SYS/broker/uptime", expected: true},
+		{filter: "status/#", topic: "status/$pump", expected: true},
+	} {
+		if actual := MatchTopic(test.filter, test.topic); actual != test.expected {
+			t.Errorf(
+				"MatchTopic(%q, %q) = %t instead of %t",
+				test.filter, test.topic, actual, test.expected,
+			)
+		}
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	for _, test := range []struct {
+		topic string
+		valid bool
+	}{
+		{topic: "actuator/pump", valid: true},
+		{topic: "status", valid: true},
+		{topic: "/", valid: true},
+		{topic: "$SYS/broker", valid: true},
+		{topic: ""},
+		{topic: "status/+"},
+		{topic: "status/#"},
+		{topic: "status/pump#"},
+		{topic: "status+/pump"},
+	} {
+		if err := ValidateTopic(test.topic); (err == nil) != test.valid {
+			t.Errorf(
+				"ValidateTopic(%q) returned error %v, but valid is %t", test.topic, err, test.valid,
+			)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		valid  bool
+	}{
+		{filter: "actuator/pump", valid: true},
+		{filter: "#", valid: true},
+		{filter: "+", valid: true},
+		{filter: "status/#", valid: true},
+		{filter: "status/+/object_id", valid: true},
+		{filter: "+/+/#", valid: true},
+		{filter: "/#", valid: true},
+		{filter: "$SYS/#", valid: true},
+		{filter: ""},
+		{filter: "status/#/object_id"},
+		{filter: "#/status"},
+		{filter: "status#"},
+		{filter: "status/pump#"},
+		{filter: "status/+pump"},
+		{filter: "status+/pump"},
+		{filter: "++"},
+	} {
+		if err := ValidateTopicFilter(test.filter); (err == nil) != test.valid {
+			t.Errorf(
+				"ValidateTopicFilter(%q) returned error %v, but valid is %t",
+				test.filter, err, test.valid,
+			)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package planktoscope
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// Token tracks the completion of an asynchronous operation of a Transport. Tokens returned by the
+// Eclipse Paho MQTT client implement this interface.
+type Token interface {
+	// Wait waits until the operation completes, and returns true.
+	Wait() bool
+	// WaitTimeout waits until the operation completes or the timeout elapses, and returns whether
+	// the operation completed.
+	WaitTimeout(timeout time.Duration) bool
+	// Done returns a channel which is closed when the operation completes.
+	Done() <-chan struct{}
+	// Error returns the error which the operation completed with, if any.
+	Error() error
+}
+
+// ConnectionHandlers are called by a Transport when the state of its connection changes.
+type ConnectionHandlers struct {
+	OnConnect        func()
+	OnConnectionLost func(err error)
+	OnReconnecting   func()
+}
+
+// Transport is a publish/subscribe connection over which the client exchanges messages with the
+// PlanktoScope's MQTT API.
+type Transport interface {
+	// SetConnectionHandlers registers the handlers to be called when the state of the connection
+	// changes; it's called by NewClient before the transport is used.
+	SetConnectionHandlers(h ConnectionHandlers)
+	Connect() Token
+	Disconnect(quiesce uint)
+	IsConnected() bool
+	IsConnectionOpen() bool
+	Publish(topic string, qos byte, retained bool, payload []byte) Token
+	Subscribe(topicFilter string, qos byte, handler func(m RawMessage)) Token
+}
+
+// Tokens
+
+type completedToken struct {
+	err  error
+	done chan struct{}
+}
+
+// NewCompletedToken makes a Token for an operation which has already completed with the specified
+// error (or with no error, if err is nil).
+func NewCompletedToken(err error) Token {
+	done := make(chan struct{})
+	close(done)
+	return &completedToken{
+		err:  err,
+		done: done,
+	}
+}
+
+func (t *completedToken) Wait() bool {
+	return true
+}
+
+func (t *completedToken) WaitTimeout(_ time.Duration) bool {
+	return true
+}
+
+func (t *completedToken) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *completedToken) Error() error {
+	return t.err
+}
+
+// Paho
+
+// PahoTransport is the default Transport, which connects to an MQTT broker using the Eclipse Paho
+// MQTT client.
+type PahoTransport struct {
+	client    mqtt.Client
+	handlers  ConnectionHandlers
+	handlersL *sync.RWMutex
+}
+
+// NewPahoTransport makes a PahoTransport with the specified MQTT client options.
+func NewPahoTransport(options mqtt.ClientOptions) *PahoTransport {
+	t := &PahoTransport{
+		handlersL: &sync.RWMutex{},
+	}
+	options.SetOnConnectHandler(func(_ mqtt.Client) {
+		if h := t.getHandlers().OnConnect; h != nil {
+			h()
+		}
+	})
+	options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		if h := t.getHandlers().OnConnectionLost; h != nil {
+			h(err)
+		}
+	})
+	options.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		if h := t.getHandlers().OnReconnecting; h != nil {
+			h()
+		}
+	})
+	t.client = mqtt.NewClient(&options)
+	return t
+}
+
+func (t *PahoTransport) getHandlers() ConnectionHandlers {
+	t.handlersL.RLock()
+	defer t.handlersL.RUnlock()
+
+	return t.handlers
+}
+
+func (t *PahoTransport) SetConnectionHandlers(h ConnectionHandlers) {
+	t.handlersL.Lock()
+	defer t.handlersL.Unlock()
+
+	t.handlers = h
+}
+
+func (t *PahoTransport) Connect() Token {
+	return t.client.Connect()
+}
+
+func (t *PahoTransport) Disconnect(quiesce uint) {
+	t.client.Disconnect(quiesce)
+}
+
+func (t *PahoTransport) IsConnected() bool {
+	return t.client.IsConnected()
+}
+
+func (t *PahoTransport) IsConnectionOpen() bool {
+	return t.client.IsConnectionOpen()
+}
+
+func (t *PahoTransport) Publish(topic string, qos byte, retained bool, payload []byte) Token {
+	return t.client.Publish(topic, qos, retained, payload)
+}
+
+func (t *PahoTransport) Subscribe(
+	topicFilter string, qos byte, handler func(m RawMessage),
+) Token {
+	return t.client.Subscribe(topicFilter, qos, func(_ mqtt.Client, m mqtt.Message) {
+		handler(RawMessage{
+			Topic:    m.Topic(),
+			QoS:      m.Qos(),
+			Retained: m.Retained(),
+			Received: time.Now(),
+			Payload:  string(m.Payload()),
+		})
+	})
+}
+
+// Dry Run
+
+// DryRunTransport is a Transport which never connects to a broker. Instead of publishing messages,
+// it passes them to a handler, e.g. to show which commands would be sent; it never receives any
+// messages.
+type DryRunTransport struct {
+	handler MessageHandler
+
+	l         *sync.RWMutex
+	handlers  ConnectionHandlers
+	connected bool
+}
+
+// NewDryRunTransport makes a DryRunTransport which passes every published message to the handler.
+func NewDryRunTransport(handler MessageHandler) *DryRunTransport {
+	return &DryRunTransport{
+		handler: handler,
+		l:       &sync.RWMutex{},
+	}
+}
+
+func (t *DryRunTransport) SetConnectionHandlers(h ConnectionHandlers) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	t.handlers = h
+}
+
+func (t *DryRunTransport) Connect() Token {
+	t.l.Lock()
+	t.connected = true
+	onConnect := t.handlers.OnConnect
+	t.l.Unlock()
+
+	if onConnect != nil {
+		onConnect()
+	}
+	return NewCompletedToken(nil)
+}
+
+func (t *DryRunTransport) Disconnect(_ uint) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	t.connected = false
+}
+
+func (t *DryRunTransport) IsConnected() bool {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	return t.connected
+}
+
+func (t *DryRunTransport) IsConnectionOpen() bool {
+	return t.IsConnected()
+}
+
+func (t *DryRunTransport) Publish(topic string, qos byte, retained bool, payload []byte) Token {
+	t.handler(RawMessage{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Received: time.Now(),
+		Payload:  string(payload),
+	})
+	return NewCompletedToken(nil)
+}
+
+func (t *DryRunTransport) Subscribe(
+	topicFilter string, qos byte, handler func(m RawMessage),
+) Token {
+	return NewCompletedToken(nil)
+}
@@ -0,0 +1,314 @@
+package planktoscope
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/pkg/errors"
+)
+
+// fakeTransport is an in-memory Transport which routes every published message to its own matching
+// subscriptions, like an MQTT broker with a single client. Messages are delivered in order on a
+// dedicated goroutine, so that message handlers can publish messages without deadlocking.
+type fakeTransport struct {
+	l          *sync.Mutex
+	handlers   ConnectionHandlers
+	connected  bool
+	published  []RawMessage
+	deliveries chan RawMessage
+
+	subscriptionsL *sync.Mutex
+	subscriptions  map[string]func(m RawMessage)
+	// onPublish, if set, is called with every published message to determine the token returned
+	// by Publish; messages are only routed to subscriptions if the token completes without error.
+	onPublish func(m RawMessage) Token
+}
+
+func newFakeTransport() *fakeTransport {
+	const deliveryBufferSize = 64
+	return &fakeTransport{
+		l:              &sync.Mutex{},
+		deliveries:     make(chan RawMessage, deliveryBufferSize),
+		subscriptionsL: &sync.Mutex{},
+		subscriptions:  make(map[string]func(m RawMessage)),
+	}
+}
+
+func (t *fakeTransport) SetConnectionHandlers(h ConnectionHandlers) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	t.handlers = h
+}
+
+func (t *fakeTransport) Connect() Token {
+	t.l.Lock()
+	t.connected = true
+	onConnect := t.handlers.OnConnect
+	t.l.Unlock()
+
+	go t.deliver()
+	if onConnect != nil {
+		onConnect()
+	}
+	return NewCompletedToken(nil)
+}
+
+func (t *fakeTransport) Disconnect(_ uint) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.connected {
+		t.connected = false
+		close(t.deliveries)
+	}
+}
+
+// loseConnection simulates an unexpected loss of the connection to the broker.
+func (t *fakeTransport) loseConnection(err error) {
+	t.l.Lock()
+	t.connected = false
+	onConnectionLost := t.handlers.OnConnectionLost
+	t.l.Unlock()
+
+	if onConnectionLost != nil {
+		onConnectionLost(err)
+	}
+}
+
+func (t *fakeTransport) IsConnected() bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	return t.connected
+}
+
+func (t *fakeTransport) IsConnectionOpen() bool {
+	return t.IsConnected()
+}
+
+func (t *fakeTransport) Publish(topic string, qos byte, retained bool, payload []byte) Token {
+	m := RawMessage{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Received: time.Now(),
+		Payload:  string(payload),
+	}
+	t.l.Lock()
+	t.published = append(t.published, m)
+	onPublish := t.onPublish
+	t.l.Unlock()
+
+	token := NewCompletedToken(nil)
+	if onPublish != nil {
+		token = onPublish(m)
+	}
+	go func() {
+		if token.Wait(); token.Error() == nil {
+			t.receive(m)
+		}
+	}()
+	return token
+}
+
+// receive delivers a message to the transport's matching subscriptions, as if the message had
+// been published by another client.
+func (t *fakeTransport) receive(m RawMessage) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if !t.connected {
+		return
+	}
+	m.Received = time.Now()
+	t.deliveries <- m
+}
+
+func (t *fakeTransport) deliver() {
+	for m := range t.deliveries {
+		t.subscriptionsL.Lock()
+		var handlers []func(m RawMessage)
+		for filter, handler := range t.subscriptions {
+			if MatchTopic(filter, m.Topic) {
+				handlers = append(handlers, handler)
+			}
+		}
+		t.subscriptionsL.Unlock()
+		for _, handler := range handlers {
+			handler(m)
+		}
+	}
+}
+
+func (t *fakeTransport) Subscribe(
+	topicFilter string, _ byte, handler func(m RawMessage),
+) Token {
+	t.subscriptionsL.Lock()
+	defer t.subscriptionsL.Unlock()
+
+	t.subscriptions[topicFilter] = handler
+	return NewCompletedToken(nil)
+}
+
+// publishedTopics returns the topics of the published messages, in order.
+func (t *fakeTransport) publishedTopics() []string {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	topics := make([]string, 0, len(t.published))
+	for _, m := range t.published {
+		topics = append(topics, m.Topic)
+	}
+	return topics
+}
+
+func newFakeClient(t *testing.T, transport Transport, responseTimeout time.Duration) *Client {
+	t.Helper()
+	logger := log.New("test")
+	logger.SetLevel(log.OFF)
+	client, err := NewClient(
+		Config{ResponseTimeout: responseTimeout}, logger, WithTransport(transport),
+	)
+	if err != nil {
+		t.Fatalf("couldn't make client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("couldn't connect client: %s", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// awaitBroadcast waits for the broadcast, failing the test if it doesn't happen within a second.
+func awaitBroadcast(t *testing.T, broadcasted <-chan struct{}, description string) {
+	t.Helper()
+	select {
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", description)
+	case <-broadcasted:
+	}
+}
+
+// awaitMessage waits for a message, failing the test if it doesn't arrive within a second.
+func awaitMessage(t *testing.T, received <-chan RawMessage) RawMessage {
+	t.Helper()
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+		return RawMessage{}
+	case m := <-received:
+		return m
+	}
+}
+
+func TestTransportRouting(t *testing.T) {
+	transport := newFakeTransport()
+	client := newFakeClient(t, transport, 0)
+	const bufferSize = 8
+	received := make(chan RawMessage, bufferSize)
+	client.AddMessageHandler(func(m RawMessage) {
+		received <- m
+	})
+
+	// The client subscribes to every topic when it connects, so messages from the PlanktoScope
+	// should be routed through the client's message handling
+	pumpUpdated := client.PumpStateBroadcasted()
+	transport.receive(RawMessage{
+		Topic:   "status/pump",
+		Payload: `{"status":"Started","duration":5}`,
+	})
+	awaitBroadcast(t, pumpUpdated, "pump state")
+	if m := awaitMessage(t, received); m.Topic != "status/pump" {
+		t.Errorf("message handler received message on %s instead of status/pump", m.Topic)
+	}
+	if state := client.GetState().Pump; !state.StateKnown || !state.Pumping {
+		t.Errorf("pump state %+v isn't known and pumping after a Started status", state)
+	}
+
+	// Commands should be published over the transport, and their echoes should be routed back
+	// to the client like any other message
+	token, err := client.StartPump(false, 2, 1)
+	if err != nil {
+		t.Fatalf("couldn't send command to start the pump: %s", err)
+	}
+	if token.Wait(); token.Error() != nil {
+		t.Fatalf("couldn't publish command to start the pump: %s", token.Error())
+	}
+	if m := awaitMessage(t, received); m.Topic != "actuator/pump" {
+		t.Errorf("message handler received message on %s instead of actuator/pump", m.Topic)
+	}
+	if topics := transport.publishedTopics(); len(topics) != 1 || topics[0] != "actuator/pump" {
+		t.Errorf("client published to %v instead of [actuator/pump]", topics)
+	}
+	expected := PumpSettings{Forward: false, Volume: 2, Flowrate: 1}
+	if settings := client.GetState().PumpSettings; settings != expected {
+		t.Errorf("pump settings %+v aren't %+v after starting the pump", settings, expected)
+	}
+
+	// Messages which fail to publish shouldn't be routed to subscriptions
+	transport.onPublish = func(m RawMessage) Token {
+		return NewCompletedToken(errors.New("broker unavailable"))
+	}
+	if token, err = client.StopPump(); err != nil {
+		t.Fatalf("couldn't send command to stop the pump: %s", err)
+	}
+	if token.Wait(); token.Error() == nil {
+		t.Error("publishing didn't fail")
+	}
+	select {
+	case m := <-received:
+		t.Errorf("message handler received unpublished message on %s", m.Topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTransportConnectionState(t *testing.T) {
+	transport := newFakeTransport()
+	client := newFakeClient(t, transport, 0)
+	if state := client.GetState().Connection; !state.Connected {
+		t.Fatalf("connection state %+v isn't connected after connecting", state)
+	}
+	select {
+	case <-client.ConnectedAtLeastOnce():
+	default:
+		t.Error("client didn't report that it connected at least once")
+	}
+
+	// Losing the connection should be broadcast to every subsystem, since their states become
+	// unknown
+	connectionUpdated := client.ConnectionStateBroadcasted()
+	pumpUpdated := client.PumpStateBroadcasted()
+	transport.loseConnection(errors.New("connection reset"))
+	awaitBroadcast(t, connectionUpdated, "connection state")
+	awaitBroadcast(t, pumpUpdated, "pump state")
+	if state := client.GetState().Connection; state.Connected || state.LostSince.IsZero() {
+		t.Errorf("connection state %+v isn't lost after losing the connection", state)
+	}
+}
+
+func TestWithoutUnhandledMessageLogs(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		logs := &bytes.Buffer{}
+		logger := log.New("test")
+		logger.SetOutput(logs)
+		logger.SetLevel(log.INFO)
+		options := []ClientOption{WithTransport(newFakeTransport())}
+		if quiet {
+			options = append(options, WithoutUnhandledMessageLogs())
+		}
+		client, err := NewClient(Config{}, logger, options...)
+		if err != nil {
+			t.Fatalf("couldn't make client: %s", err)
+		}
+		client.processMessage(RawMessage{Topic: "custom/topic", Payload: `{"key":"value"}`})
+		client.processMessage(RawMessage{Topic: "custom/raw", Payload: "not JSON"})
+		if logged := strings.Contains(logs.String(), "custom/"); logged == quiet {
+			t.Errorf("client with quiet %t logged unhandled messages: %t", quiet, logged)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package discovery finds PlanktoScopes on the local network by browsing for services advertised
+// over mDNS/DNS-SD
+package discovery
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Options describes how to browse for PlanktoScopes.
+type Options struct {
+	// Services lists the DNS-SD service types to browse for, e.g. "_workstation._tcp".
+	Services []string
+	// HostPrefix is the prefix of the hostnames of PlanktoScopes; hosts whose hostnames and service
+	// instance names don't start with the prefix are ignored. An empty prefix matches every host.
+	HostPrefix string
+	// MQTTPort is the port to probe for the MQTT broker of each PlanktoScope.
+	MQTTPort uint16
+	// ProbeTimeout is how long to wait for each MQTT port to accept a connection.
+	ProbeTimeout time.Duration
+}
+
+func DefaultOptions() Options {
+	const (
+		defaultMQTTPort     = 1883
+		defaultProbeTimeout = 1 * time.Second
+	)
+	return Options{
+		// PlanktoScope OS advertises these services with Avahi
+		Services:     []string{"_workstation._tcp", "_ssh._tcp", "_http._tcp", "_mqtt._tcp"},
+		HostPrefix:   "planktoscope",
+		MQTTPort:     defaultMQTTPort,
+		ProbeTimeout: defaultProbeTimeout,
+	}
+}
+
+// Host is a PlanktoScope found on the local network.
+type Host struct {
+	// Hostname is the mDNS hostname of the PlanktoScope, e.g. "planktoscope-chain-rule.local".
+	Hostname  string   `json:"hostname"`
+	Addresses []net.IP `json:"addresses"`
+	// Instances lists the DNS-SD service instances advertised by the PlanktoScope.
+	Instances []string `json:"instances"`
+	// API is the URL of the PlanktoScope's MQTT API, or empty if the MQTT port was unreachable.
+	API string `json:"api,omitempty"`
+}
+
+// Name returns the hostname without the ".local" domain, for use as a short name for the host.
+func (h Host) Name() string {
+	return strings.TrimSuffix(h.Hostname, ".local")
+}
+
+// Discover browses the local network for PlanktoScopes until the context is done, and then probes
+// the MQTT port of each PlanktoScope which was found.
+func Discover(ctx context.Context, o Options) ([]Host, error) {
+	records, err := browse(ctx, o.Services)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't browse for services")
+	}
+	hosts := records.hosts(o.HostPrefix)
+	for i, host := range hosts {
+		hosts[i].API = probeMQTT(host, o.MQTTPort, o.ProbeTimeout)
+	}
+	return hosts, nil
+}
+
+// probeMQTT returns the URL of the host's MQTT API if the host accepts TCP connections on the port,
+// preferring the host's mDNS hostname over its addresses.
+func probeMQTT(host Host, port uint16, timeout time.Duration) string {
+	portRaw := strconv.FormatUint(uint64(port), 10)
+	for _, address := range host.Addresses {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(address.String(), portRaw), timeout)
+		if err != nil {
+			continue
+		}
+		_ = conn.Close()
+		return "mqtt://" + net.JoinHostPort(host.Hostname, portRaw)
+	}
+	return ""
+}
+
+// Records
+
+// records accumulates the DNS-SD records received while browsing.
+type records struct {
+	// instances maps service types to the names of their service instances.
+	instances map[string]map[string]struct{}
+	// targets maps service instance names to the hostnames of the hosts providing them.
+	targets map[string]string
+	// addresses maps hostnames to their addresses.
+	addresses map[string]map[string]net.IP
+}
+
+func newRecords() *records {
+	return &records{
+		instances: make(map[string]map[string]struct{}),
+		targets:   make(map[string]string),
+		addresses: make(map[string]map[string]net.IP),
+	}
+}
+
+func (r *records) addInstance(service, instance string) {
+	if _, ok := r.instances[service]; !ok {
+		r.instances[service] = make(map[string]struct{})
+	}
+	r.instances[service][instance] = struct{}{}
+}
+
+func (r *records) addAddress(hostname string, address net.IP) {
+	if _, ok := r.addresses[hostname]; !ok {
+		r.addresses[hostname] = make(map[string]net.IP)
+	}
+	r.addresses[hostname][address.String()] = address
+}
+
+// unresolved returns the service instances without known hostnames and the hostnames without
+// known addresses.
+func (r *records) unresolved() (instances, hostnames []string) {
+	for _, serviceInstances := range r.instances {
+		for instance := range serviceInstances {
+			if _, ok := r.targets[instance]; !ok {
+				instances = append(instances, instance)
+			}
+		}
+	}
+	for _, hostname := range r.targets {
+		if _, ok := r.addresses[hostname]; !ok {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return instances, hostnames
+}
+
+func hasPrefix(name, prefix string) bool {
+	return strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix))
+}
+
+// hosts groups the service instances by the hosts providing them, keeping only hosts whose
+// hostnames or instance names start with the prefix.
+func (r *records) hosts(prefix string) []Host {
+	byHostname := make(map[string]*Host)
+	for _, serviceInstances := range r.instances {
+		for instance := range serviceInstances {
+			hostname, ok := r.targets[instance]
+			if !ok {
+				continue
+			}
+			if !hasPrefix(hostname, prefix) && !hasPrefix(instance, prefix) {
+				continue
+			}
+			host, ok := byHostname[hostname]
+			if !ok {
+				host = &Host{Hostname: strings.TrimSuffix(hostname, ".")}
+				for _, address := range r.addresses[hostname] {
+					host.Addresses = append(host.Addresses, address)
+				}
+				sort.Slice(host.Addresses, func(i, j int) bool {
+					// Prefer IPv4 addresses, which are more likely to be routable on a LAN
+					iv4, jv4 := host.Addresses[i].To4() != nil, host.Addresses[j].To4() != nil
+					if iv4 != jv4 {
+						return iv4
+					}
+					return host.Addresses[i].String() < host.Addresses[j].String()
+				})
+				byHostname[hostname] = host
+			}
+			host.Instances = append(host.Instances, instance)
+		}
+	}
+
+	hosts := make([]Host, 0, len(byHostname))
+	for _, host := range byHostname {
+		sort.Strings(host.Instances)
+		hosts = append(hosts, *host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Hostname < hosts[j].Hostname
+	})
+	return hosts
+}
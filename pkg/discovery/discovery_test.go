@@ -0,0 +1,68 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestHosts(t *testing.T) {
+	const (
+		renamedInstance = "PlanktoScope Lab Bench._workstation._tcp.local."
+		renamedHostname = "raspberrypi.local."
+		otherInstance   = "nas._ssh._tcp.local."
+		otherHostname   = "nas.local."
+		// unresolvedInstance has no SRV record, so its host is unknown
+		unresolvedInstance = "planktoscope-unresolved._ssh._tcp.local."
+	)
+	r := parseAll(t, response(
+		t,
+		[]dnsmessage.Resource{
+			ptr(workstation, instance), ptr(ssh, sshInstance), ptr(workstation, renamedInstance),
+			ptr(ssh, otherInstance), ptr(ssh, unresolvedInstance),
+		},
+		[]dnsmessage.Resource{
+			srv(instance, hostname), srv(sshInstance, hostname),
+			srv(renamedInstance, renamedHostname), srv(otherInstance, otherHostname),
+			aaaa(hostname, "fe80::1"), a(hostname, "192.168.4.1"), a(hostname, "10.0.0.2"),
+			a(renamedHostname, "192.168.4.2"), a(otherHostname, "192.168.4.3"),
+		},
+	))
+	planktoscope := Host{
+		Hostname: "planktoscope-chain-rule.local",
+		Addresses: []net.IP{
+			net.ParseIP("10.0.0.2").To4(), net.ParseIP("192.168.4.1").To4(), net.ParseIP("fe80::1"),
+		},
+		Instances: []string{instance, sshInstance},
+	}
+	renamed := Host{
+		Hostname:  "raspberrypi.local",
+		Addresses: []net.IP{net.ParseIP("192.168.4.2").To4()},
+		Instances: []string{renamedInstance},
+	}
+	other := Host{
+		Hostname:  "nas.local",
+		Addresses: []net.IP{net.ParseIP("192.168.4.3").To4()},
+		Instances: []string{otherInstance},
+	}
+
+	for _, test := range []struct {
+		prefix   string
+		expected []Host
+	}{
+		{prefix: "", expected: []Host{other, planktoscope, renamed}},
+		// Hosts match if either their hostname or the name of one of their instances matches,
+		// ignoring case
+		{prefix: "planktoscope", expected: []Host{planktoscope, renamed}},
+		{prefix: "PLANKTOSCOPE-chain", expected: []Host{planktoscope}},
+		{prefix: "raspberrypi", expected: []Host{renamed}},
+		{prefix: "planktoscope-unresolved", expected: nil},
+		{prefix: "printer", expected: nil},
+	} {
+		test := test
+		t.Run(test.prefix, func(t *testing.T) {
+			checkHosts(t, r.hosts(test.prefix), test.expected)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsAddress is the IPv4 multicast address of mDNS.
+var mdnsAddress = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// querier sends mDNS queries from an ephemeral port, so that responders send legacy unicast
+// responses (as specified by RFC 6762 section 6.7) directly to the querier; this way, we don't need
+// to share port 5353 with any mDNS responder running on the same computer.
+type querier struct {
+	conn *net.UDPConn
+	pc   *ipv4.PacketConn
+	// sent records the queries which were already sent, so that each query is only sent once.
+	sent map[dnsmessage.Question]struct{}
+}
+
+func newQuerier() (*querier, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't open UDP socket")
+	}
+	pc := ipv4.NewPacketConn(conn)
+	const mdnsTTL = 255 // per RFC 6762 section 11
+	_ = pc.SetMulticastTTL(mdnsTTL)
+	return &querier{
+		conn: conn,
+		pc:   pc,
+		sent: make(map[dnsmessage.Question]struct{}),
+	}, nil
+}
+
+// query sends a query with any of the questions which weren't previously sent, on every network
+// interface which supports multicast.
+func (q *querier) query(questions []dnsmessage.Question) error {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return err
+	}
+	added := 0
+	for _, question := range questions {
+		if _, ok := q.sent[question]; ok {
+			continue
+		}
+		q.sent[question] = struct{}{}
+		if err := b.Question(question); err != nil {
+			return errors.Wrapf(err, "couldn't add question for %s", question.Name)
+		}
+		added++
+	}
+	if added == 0 {
+		return nil
+	}
+	message, err := b.Finish()
+	if err != nil {
+		return errors.Wrap(err, "couldn't build query")
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return errors.Wrap(err, "couldn't list network interfaces")
+	}
+	sent := false
+	for i := range interfaces {
+		iface := interfaces[i]
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if err := q.pc.SetMulticastInterface(&iface); err != nil {
+			continue
+		}
+		if _, err := q.conn.WriteTo(message, mdnsAddress); err == nil {
+			sent = true
+		}
+	}
+	if !sent {
+		// Fall back to the interface chosen by the operating system
+		_, err = q.conn.WriteTo(message, mdnsAddress)
+		return errors.Wrap(err, "couldn't send query")
+	}
+	return nil
+}
+
+func (q *querier) close() error {
+	return q.conn.Close()
+}
+
+func makeQuestion(name string, t dnsmessage.Type) (dnsmessage.Question, error) {
+	parsed, err := dnsmessage.NewName(name)
+	if err != nil {
+		return dnsmessage.Question{}, errors.Wrapf(err, "invalid name %s", name)
+	}
+	return dnsmessage.Question{Name: parsed, Type: t, Class: dnsmessage.ClassINET}, nil
+}
+
+// browse sends DNS-SD queries for the service types and for the hostnames and addresses of their
+// instances, and collects responses until the context is done.
+func browse(ctx context.Context, services []string) (*records, error) {
+	q, err := newQuerier()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = q.close()
+	}()
+
+	serviceNames := make(map[string]string)
+	questions := make([]dnsmessage.Question, 0, len(services))
+	for _, service := range services {
+		name := strings.TrimSuffix(service, ".") + ".local."
+		serviceNames[strings.ToLower(name)] = name
+		question, err := makeQuestion(name, dnsmessage.TypePTR)
+		if err != nil {
+			return nil, err
+		}
+		questions = append(questions, question)
+	}
+	if err = q.query(questions); err != nil {
+		return nil, err
+	}
+
+	r := newRecords()
+	const maxMessageSize = 9000 // bytes, per RFC 6762 section 17
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, _, err := q.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return r, nil
+			}
+			return r, errors.Wrap(err, "couldn't receive response")
+		}
+		// Malformed responses from other devices shouldn't stop discovery
+		_ = r.parse(buf[:n], serviceNames)
+		if err = q.query(r.followUpQuestions()); err != nil {
+			return r, err
+		}
+	}
+}
+
+// followUpQuestions makes questions to resolve the hostnames and addresses of service instances.
+func (r *records) followUpQuestions() []dnsmessage.Question {
+	instances, hostnames := r.unresolved()
+	questions := make([]dnsmessage.Question, 0, len(instances)+len(hostnames))
+	for _, instance := range instances {
+		if question, err := makeQuestion(instance, dnsmessage.TypeSRV); err == nil {
+			questions = append(questions, question)
+		}
+	}
+	for _, hostname := range hostnames {
+		if question, err := makeQuestion(hostname, dnsmessage.TypeA); err == nil {
+			questions = append(questions, question)
+		}
+	}
+	return questions
+}
+
+// parse adds the records in an mDNS response to the records. PTR records are only added for the
+// service types which are being browsed.
+func (r *records) parse(message []byte, serviceNames map[string]string) error {
+	var p dnsmessage.Parser
+	header, err := p.Start(message)
+	if err != nil {
+		return errors.Wrap(err, "couldn't parse header")
+	}
+	if !header.Response {
+		return nil
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return errors.Wrap(err, "couldn't parse questions")
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return errors.Wrap(err, "couldn't parse answers")
+	}
+	if err = p.SkipAllAuthorities(); err != nil {
+		return errors.Wrap(err, "couldn't parse authorities")
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return errors.Wrap(err, "couldn't parse additional records")
+	}
+
+	for _, resource := range append(answers, additionals...) {
+		name := resource.Header.Name.String()
+		switch body := resource.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if service, ok := serviceNames[strings.ToLower(name)]; ok {
+				r.addInstance(service, body.PTR.String())
+			}
+		case *dnsmessage.SRVResource:
+			r.targets[name] = body.Target.String()
+		case *dnsmessage.AResource:
+			r.addAddress(name, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			r.addAddress(name, net.IP(body.AAAA[:]))
+		}
+	}
+	return nil
+}
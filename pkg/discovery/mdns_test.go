@@ -0,0 +1,218 @@
+package discovery
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Fixtures
+
+func resource(name string, t dnsmessage.Type, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	const ttl = 120 // s
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name: dnsmessage.MustNewName(name), Type: t, Class: dnsmessage.ClassINET, TTL: ttl,
+		},
+		Body: body,
+	}
+}
+
+func ptr(service, instance string) dnsmessage.Resource {
+	return resource(
+		service, dnsmessage.TypePTR,
+		&dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(instance)},
+	)
+}
+
+func srv(instance, target string) dnsmessage.Resource {
+	const port = 22
+	return resource(
+		instance, dnsmessage.TypeSRV,
+		&dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port},
+	)
+}
+
+func a(hostname, address string) dnsmessage.Resource {
+	var body dnsmessage.AResource
+	copy(body.A[:], net.ParseIP(address).To4())
+	return resource(hostname, dnsmessage.TypeA, &body)
+}
+
+func aaaa(hostname, address string) dnsmessage.Resource {
+	var body dnsmessage.AAAAResource
+	copy(body.AAAA[:], net.ParseIP(address).To16())
+	return resource(hostname, dnsmessage.TypeAAAA, &body)
+}
+
+// response packs an mDNS response with the answers and additional records.
+func response(t *testing.T, answers, additionals []dnsmessage.Resource) []byte {
+	t.Helper()
+	message := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	packed, err := message.Pack()
+	if err != nil {
+		t.Fatalf("couldn't pack response: %s", err)
+	}
+	return packed
+}
+
+// browsedServices maps the lowercase names of the browsed service types to their names, like the
+// map made by browse.
+var browsedServices = map[string]string{
+	"_workstation._tcp.local.": "_workstation._tcp.local.",
+	"_ssh._tcp.local.":         "_ssh._tcp.local.",
+}
+
+// parseAll parses the messages into new records, failing the test if any message is malformed.
+func parseAll(t *testing.T, messages ...[]byte) *records {
+	t.Helper()
+	r := newRecords()
+	for i, message := range messages {
+		if err := r.parse(message, browsedServices); err != nil {
+			t.Fatalf("couldn't parse message %d: %s", i, err)
+		}
+	}
+	return r
+}
+
+// Tests
+
+const (
+	workstation = "_workstation._tcp.local."
+	ssh         = "_ssh._tcp.local."
+	instance    = "planktoscope-chain-rule [b8:27:eb:01:02:03]._workstation._tcp.local."
+	sshInstance = "planktoscope-chain-rule._ssh._tcp.local."
+	hostname    = "planktoscope-chain-rule.local."
+)
+
+func TestParseResolutionChain(t *testing.T) {
+	// Responders may answer each question of the PTR→SRV→A/AAAA chain in a separate response
+	r := parseAll(t, response(t, []dnsmessage.Resource{ptr(workstation, instance)}, nil))
+	instances, hostnames := r.unresolved()
+	if !reflect.DeepEqual(instances, []string{instance}) || len(hostnames) > 0 {
+		t.Errorf("unresolved instances %v and hostnames %v after PTR record", instances, hostnames)
+	}
+	checkQuestions(t, r, []string{instance + " TypeSRV"})
+
+	if err := r.parse(
+		response(t, []dnsmessage.Resource{srv(instance, hostname)}, nil), browsedServices,
+	); err != nil {
+		t.Fatalf("couldn't parse SRV response: %s", err)
+	}
+	checkQuestions(t, r, []string{hostname + " TypeA"})
+
+	if err := r.parse(response(t, []dnsmessage.Resource{
+		a(hostname, "192.168.4.1"), aaaa(hostname, "fe80::1"),
+	}, nil), browsedServices); err != nil {
+		t.Fatalf("couldn't parse address response: %s", err)
+	}
+	checkQuestions(t, r, nil)
+	expected := []Host{{
+		Hostname:  "planktoscope-chain-rule.local",
+		Addresses: []net.IP{net.ParseIP("192.168.4.1").To4(), net.ParseIP("fe80::1")},
+		Instances: []string{instance},
+	}}
+	checkHosts(t, r.hosts("planktoscope"), expected)
+}
+
+func TestParseAdditionalRecords(t *testing.T) {
+	// Responders usually send the whole chain at once, with the SRV and address records as
+	// additional records
+	r := parseAll(t, response(
+		t,
+		[]dnsmessage.Resource{ptr(workstation, instance)},
+		[]dnsmessage.Resource{srv(instance, hostname), a(hostname, "192.168.4.1")},
+	))
+	checkQuestions(t, r, nil)
+	checkHosts(t, r.hosts(""), []Host{{
+		Hostname:  "planktoscope-chain-rule.local",
+		Addresses: []net.IP{net.ParseIP("192.168.4.1").To4()},
+		Instances: []string{instance},
+	}})
+}
+
+func TestParseDuplicateAnswers(t *testing.T) {
+	// Responders on multiple interfaces, or repeated responses, produce duplicate records which
+	// shouldn't produce duplicate instances or addresses
+	chain := []dnsmessage.Resource{
+		ptr(workstation, instance), srv(instance, hostname), a(hostname, "192.168.4.1"),
+	}
+	r := parseAll(
+		t,
+		response(t, append(chain, chain...), nil),
+		response(t, chain, []dnsmessage.Resource{a(hostname, "192.168.4.1")}),
+	)
+	checkHosts(t, r.hosts(""), []Host{{
+		Hostname:  "planktoscope-chain-rule.local",
+		Addresses: []net.IP{net.ParseIP("192.168.4.1").To4()},
+		Instances: []string{instance},
+	}})
+}
+
+func TestParseIgnoredRecords(t *testing.T) {
+	query := dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: false},
+		Answers: []dnsmessage.Resource{ptr(workstation, instance)},
+	}
+	packedQuery, err := query.Pack()
+	if err != nil {
+		t.Fatalf("couldn't pack query: %s", err)
+	}
+	r := parseAll(
+		t,
+		// Queries from other browsers may contain known answers, which aren't responses
+		packedQuery,
+		// PTR records for services which aren't being browsed should be ignored
+		response(t, []dnsmessage.Resource{
+			ptr("_printer._tcp.local.", "printer._printer._tcp.local."),
+		}, nil),
+	)
+	if len(r.instances) > 0 {
+		t.Errorf("records have instances %v from ignored records", r.instances)
+	}
+
+	if err = r.parse([]byte{0x00, 0x01, 0x02}, browsedServices); err == nil {
+		t.Error("malformed message was parsed without errors")
+	}
+}
+
+func TestParseServiceCase(t *testing.T) {
+	// DNS names are case-insensitive, but instances are recorded with the browsed service's name
+	r := parseAll(t, response(t, []dnsmessage.Resource{
+		ptr("_SSH._tcp.local.", sshInstance),
+	}, nil))
+	if _, ok := r.instances[ssh][sshInstance]; !ok {
+		t.Errorf("records have instances %v instead of %s for %s", r.instances, sshInstance, ssh)
+	}
+}
+
+// Helpers
+
+// checkQuestions checks the follow-up questions of the records, which are described by their names
+// and types, e.g. "planktoscope-chain-rule.local. TypeA".
+func checkQuestions(t *testing.T, r *records, expected []string) {
+	t.Helper()
+	questions := r.followUpQuestions()
+	actual := make([]string, 0, len(questions))
+	for _, question := range questions {
+		actual = append(actual, question.Name.String()+" "+question.Type.String())
+	}
+	sort.Strings(actual)
+	if len(actual) != len(expected) || (len(actual) > 0 && !reflect.DeepEqual(actual, expected)) {
+		t.Errorf("follow-up questions are %v instead of %v", actual, expected)
+	}
+}
+
+func checkHosts(t *testing.T, actual, expected []Host) {
+	t.Helper()
+	if len(actual) != len(expected) || (len(actual) > 0 && !reflect.DeepEqual(actual, expected)) {
+		t.Errorf("hosts are %+v instead of %+v", actual, expected)
+	}
+}
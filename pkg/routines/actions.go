@@ -0,0 +1,213 @@
+package routines
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+// Result describes the outcome of a step.
+type Result struct {
+	// Status is the final status of the operation reported by the PlanktoScope, if any.
+	Status string `json:"status,omitempty"`
+	// Frames is the number of frames acquired by an image step or segmented by a segment step.
+	Frames uint64 `json:"frames,omitempty"`
+}
+
+// action is the operation performed by a step.
+type action interface {
+	// run performs the operation and waits until the PlanktoScope has finished it.
+	run(ctx context.Context, client *planktoscope.Client) (Result, error)
+	// stop stops the operation on the PlanktoScope, for when run returns before the PlanktoScope has
+	// finished the operation.
+	stop(ctx context.Context, client *planktoscope.Client) error
+}
+
+// actionDecoders decodes the parameters of each kind of step.
+var actionDecoders = map[string]func(
+	params hcl.Body, evalCtx *hcl.EvalContext,
+) (action, hcl.Diagnostics){
+	"pump":    decodePumpAction,
+	"camera":  decodeCameraAction,
+	"image":   decodeImageAction,
+	"segment": decodeSegmentAction,
+	"wait":    decodeWaitAction,
+}
+
+// actionKinds returns the kinds of steps, in alphabetical order.
+func actionKinds() []string {
+	kinds := make([]string, 0, len(actionDecoders))
+	for kind := range actionDecoders {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func invalidParam(params hcl.Body, summary, detail string) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  summary,
+		Detail:   detail,
+		Subject:  params.MissingItemRange().Ptr(),
+	}
+}
+
+// Pump
+
+type pumpAction planktoscope.PlanktoscopePumpParams
+
+func decodePumpAction(params hcl.Body, evalCtx *hcl.EvalContext) (action, hcl.Diagnostics) {
+	var p planktoscope.PlanktoscopePumpParams
+	if diags := gohcl.DecodeBody(params, evalCtx, &p); diags.HasErrors() {
+		return nil, diags
+	}
+	if p.Volume <= 0 {
+		return nil, hcl.Diagnostics{
+			invalidParam(params, "Invalid volume", "The volume to pump must be positive."),
+		}
+	}
+	if p.Flowrate <= 0 {
+		return nil, hcl.Diagnostics{
+			invalidParam(params, "Invalid flowrate", "The flowrate of the pump must be positive."),
+		}
+	}
+	return pumpAction(p), nil
+}
+
+func (a pumpAction) run(ctx context.Context, client *planktoscope.Client) (Result, error) {
+	result, err := client.RunPumpActionToCompletion(ctx, planktoscope.PlanktoscopePumpParams(a))
+	return Result{Status: result.Status}, err
+}
+
+func (a pumpAction) stop(ctx context.Context, client *planktoscope.Client) error {
+	return client.RunStopPumpAction(ctx)
+}
+
+// Camera
+
+type cameraAction planktoscope.PlanktoscopeCameraParams
+
+func decodeCameraAction(params hcl.Body, evalCtx *hcl.EvalContext) (action, hcl.Diagnostics) {
+	var p planktoscope.PlanktoscopeCameraParams
+	if diags := gohcl.DecodeBody(params, evalCtx, &p); diags.HasErrors() {
+		return nil, diags
+	}
+	if err := planktoscope.ValidateCameraSettings(p.Settings()); err != nil {
+		return nil, hcl.Diagnostics{
+			invalidParam(params, "Invalid camera settings", err.Error()+"."),
+		}
+	}
+	return cameraAction(p), nil
+}
+
+func (a cameraAction) run(ctx context.Context, client *planktoscope.Client) (Result, error) {
+	return Result{}, client.RunCameraAction(ctx, planktoscope.PlanktoscopeCameraParams(a))
+}
+
+func (a cameraAction) stop(ctx context.Context, client *planktoscope.Client) error {
+	// Camera settings are changed immediately, so there's nothing to stop
+	return nil
+}
+
+// Image
+
+type imageAction planktoscope.PlanktoscopeImagingParams
+
+func decodeImageAction(params hcl.Body, evalCtx *hcl.EvalContext) (action, hcl.Diagnostics) {
+	var p planktoscope.PlanktoscopeImagingParams
+	if diags := gohcl.DecodeBody(params, evalCtx, &p); diags.HasErrors() {
+		return nil, diags
+	}
+	if p.Steps == 0 {
+		return nil, hcl.Diagnostics{
+			invalidParam(params, "Invalid steps", "The number of frames to acquire must be positive."),
+		}
+	}
+	return imageAction(p), nil
+}
+
+func (a imageAction) run(ctx context.Context, client *planktoscope.Client) (Result, error) {
+	result, err := client.RunImagingActionToCompletion(
+		ctx, planktoscope.PlanktoscopeImagingParams(a),
+	)
+	return Result{Status: result.Status, Frames: result.Frames}, err
+}
+
+func (a imageAction) stop(ctx context.Context, client *planktoscope.Client) error {
+	return client.RunStopImagingAction(ctx)
+}
+
+// Segment
+
+type segmentAction planktoscope.PlanktoscopeSegmentingParams
+
+func decodeSegmentAction(params hcl.Body, evalCtx *hcl.EvalContext) (action, hcl.Diagnostics) {
+	var p planktoscope.PlanktoscopeSegmentingParams
+	if diags := gohcl.DecodeBody(params, evalCtx, &p); diags.HasErrors() {
+		return nil, diags
+	}
+	if len(p.Paths) == 0 {
+		return nil, hcl.Diagnostics{
+			invalidParam(params, "Invalid paths", "At least one path must be segmented."),
+		}
+	}
+	return segmentAction(p), nil
+}
+
+func (a segmentAction) run(ctx context.Context, client *planktoscope.Client) (Result, error) {
+	result, err := client.RunSegmentingActionToCompletion(
+		ctx, planktoscope.PlanktoscopeSegmentingParams(a),
+	)
+	return Result{Status: result.Status, Frames: result.Frames}, err
+}
+
+func (a segmentAction) stop(ctx context.Context, client *planktoscope.Client) error {
+	return client.RunStopSegmentingAction(ctx)
+}
+
+// Wait
+
+type waitAction struct {
+	duration time.Duration
+}
+
+func decodeWaitAction(params hcl.Body, evalCtx *hcl.EvalContext) (action, hcl.Diagnostics) {
+	var p struct {
+		Duration string `hcl:"duration"`
+	}
+	if diags := gohcl.DecodeBody(params, evalCtx, &p); diags.HasErrors() {
+		return nil, diags
+	}
+	duration, err := time.ParseDuration(p.Duration)
+	if err != nil || duration < 0 {
+		return nil, hcl.Diagnostics{invalidParam(
+			params, "Invalid duration",
+			"The duration must be a non-negative duration, such as \"90s\" or \"10m\".",
+		)}
+	}
+	return waitAction{duration: duration}, nil
+}
+
+func (a waitAction) run(ctx context.Context, client *planktoscope.Client) (Result, error) {
+	if client.DryRun() {
+		return Result{}, nil
+	}
+	timer := time.NewTimer(a.duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	case <-timer.C:
+		return Result{}, nil
+	}
+}
+
+func (a waitAction) stop(ctx context.Context, client *planktoscope.Client) error {
+	return nil
+}
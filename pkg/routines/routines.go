@@ -0,0 +1,433 @@
+// Package routines runs routines of operations on a PlanktoScope, which are declared as sequences
+// of steps in HCL files
+package routines
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/pkg/errors"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// Routine is a validated sequence of steps to run on a PlanktoScope. Any repeat blocks in the
+// routine file are expanded into the steps of each of their iterations.
+type Routine struct {
+	Steps []Step
+}
+
+// Step is an operation in a routine.
+type Step struct {
+	// Kind is the type of operation, e.g. "pump" or "image".
+	Kind string
+	// Timeout is the maximum duration of the step, or 0 if the step has no timeout.
+	Timeout time.Duration
+	// Range is the location of the step's declaration in the routine file.
+	Range hcl.Range
+
+	action action
+	// when is the condition for running the step, which is evaluated in evalCtx with the result of
+	// the previous step; it's nil if the step always runs.
+	when    hcl.Expression
+	evalCtx *hcl.EvalContext
+}
+
+// routineSchema is the schema of a routine file.
+var routineSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "variables"},
+		{Type: "step", LabelNames: []string{"kind"}},
+		{Type: "repeat"},
+	},
+}
+
+// repeatSchema is the schema of a repeat block in a routine file.
+var repeatSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "for_each"},
+		{Name: "count"},
+		{Name: "interval"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "step", LabelNames: []string{"kind"}},
+		{Type: "repeat"},
+	},
+}
+
+// stepConfig is the body of a step block in a routine file. Any attributes other than the timeout
+// and the condition are the parameters of the step's operation.
+type stepConfig struct {
+	Timeout string         `hcl:"timeout,optional"`
+	When    hcl.Expression `hcl:"when,optional"`
+	Params  hcl.Body       `hcl:",remain"`
+}
+
+// ReadFile reads and validates a routine from an HCL file. Values in vars override the values of
+// the variables declared in the file.
+func ReadFile(path string, vars map[string]cty.Value) (*Routine, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read %s", path)
+	}
+	return Parse(src, path, vars)
+}
+
+// Parse parses and validates a routine from the HCL source of a routine file. The filename is
+// only used in error messages. Values in vars override the values of the variables declared in
+// the file.
+func Parse(src []byte, filename string, vars map[string]cty.Value) (*Routine, error) {
+	file, diags := hclsyntax.ParseConfig(src, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, errors.Wrapf(diags, "couldn't parse %s", filename)
+	}
+	content, diags := file.Body.Content(routineSchema)
+	if diags.HasErrors() {
+		return nil, errors.Wrapf(diags, "couldn't decode %s", filename)
+	}
+
+	evalCtx, diags := makeEvalContext(content.Blocks, vars)
+	if diags.HasErrors() {
+		return nil, errors.Errorf("invalid variables in %s:\n%s", filename, formatDiagnostics(diags))
+	}
+	// We report every invalid step at once, so that a routine can be fixed in a single pass
+	steps, diags := expandBlocks(content.Blocks, evalCtx)
+	if diags.HasErrors() {
+		return nil, errors.Errorf("invalid routine in %s:\n%s", filename, formatDiagnostics(diags))
+	}
+	return &Routine{Steps: steps}, nil
+}
+
+// formatDiagnostics lists every diagnostic on its own line, unlike hcl.Diagnostics.Error, which
+// only shows the first diagnostic.
+func formatDiagnostics(diags hcl.Diagnostics) string {
+	lines := make([]string, 0, len(diags))
+	for _, diag := range diags {
+		if diag.Subject == nil {
+			lines = append(lines, fmt.Sprintf("  %s; %s", diag.Summary, diag.Detail))
+			continue
+		}
+		lines = append(lines, "  "+diag.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Variables
+
+// makeEvalContext makes the context for evaluating expressions in the routine file, in which the
+// variables declared by the variables blocks are available as attributes of var.
+func makeEvalContext(
+	blocks hcl.Blocks, overrides map[string]cty.Value,
+) (evalCtx *hcl.EvalContext, diags hcl.Diagnostics) {
+	vars := make(map[string]cty.Value)
+	for _, block := range blocks {
+		if block.Type != "variables" {
+			continue
+		}
+		attrs, attrDiags := block.Body.JustAttributes()
+		diags = append(diags, attrDiags...)
+		for name, attr := range attrs {
+			if _, ok := vars[name]; ok {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate variable",
+					Detail:   fmt.Sprintf("The variable %q was already declared.", name),
+					Subject:  attr.NameRange.Ptr(),
+				})
+				continue
+			}
+			value, valueDiags := attr.Expr.Value(nil)
+			diags = append(diags, valueDiags...)
+			vars[name] = value
+		}
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := vars[name]; !ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Undeclared variable",
+				Detail: fmt.Sprintf(
+					"A value was provided for the variable %q, which isn't declared in any "+
+						"variables block.", name,
+				),
+			})
+			continue
+		}
+		vars[name] = overrides[name]
+	}
+	return &hcl.EvalContext{
+		Variables: map[string]cty.Value{"var": cty.ObjectVal(vars)},
+	}, diags
+}
+
+// ParseVariable parses the value of a variable from an HCL expression, e.g. 5 or ["a", "b"]. A
+// value which isn't a valid expression without variables, e.g. sample-1, is parsed as a string.
+func ParseVariable(raw string) cty.Value {
+	expr, diags := hclsyntax.ParseExpression([]byte(raw), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return cty.StringVal(raw)
+	}
+	value, diags := expr.Value(nil)
+	if diags.HasErrors() {
+		return cty.StringVal(raw)
+	}
+	return value
+}
+
+// Blocks
+
+// expandBlocks decodes the step blocks and expands the repeat blocks among the blocks, in order.
+func expandBlocks(
+	blocks hcl.Blocks, evalCtx *hcl.EvalContext,
+) (steps []Step, diags hcl.Diagnostics) {
+	for _, block := range blocks {
+		switch block.Type {
+		case "step":
+			step, stepDiags := decodeStep(block, evalCtx)
+			diags = append(diags, stepDiags...)
+			steps = append(steps, step)
+		case "repeat":
+			repeated, repeatDiags := expandRepeat(block, evalCtx)
+			diags = append(diags, repeatDiags...)
+			steps = append(steps, repeated...)
+		}
+	}
+	return steps, diags
+}
+
+// expandRepeat expands a repeat block into the steps of each of its iterations, with a wait step
+// between iterations if the block sets an interval. In each iteration, the index of the iteration
+// and (for for_each) the element of the collection are available as each.index and each.value.
+func expandRepeat(
+	block *hcl.Block, evalCtx *hcl.EvalContext,
+) (steps []Step, diags hcl.Diagnostics) {
+	content, diags := block.Body.Content(repeatSchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	values, diags := repeatValues(block, content.Attributes, evalCtx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var interval time.Duration
+	if attr, ok := content.Attributes["interval"]; ok {
+		var raw string
+		if diags = gohcl.DecodeExpression(attr.Expr, evalCtx, &raw); diags.HasErrors() {
+			return nil, diags
+		}
+		var err error
+		if interval, err = time.ParseDuration(raw); err != nil || interval < 0 {
+			return nil, hcl.Diagnostics{invalidDuration("interval", attr.Expr.Range())}
+		}
+	}
+
+	for i, value := range values {
+		if i > 0 && interval > 0 {
+			steps = append(steps, Step{
+				Kind:   "wait",
+				Range:  block.DefRange,
+				action: waitAction{duration: interval},
+			})
+		}
+		iterationCtx := evalCtx.NewChild()
+		iterationCtx.Variables = map[string]cty.Value{
+			"each": cty.ObjectVal(map[string]cty.Value{
+				"index": cty.NumberIntVal(int64(i)),
+				"value": value,
+			}),
+		}
+		iterationSteps, iterationDiags := expandBlocks(content.Blocks, iterationCtx)
+		steps = append(steps, iterationSteps...)
+		if iterationDiags.HasErrors() {
+			// Every iteration would probably have the same errors, so we only report them once
+			return steps, iterationDiags
+		}
+	}
+	return steps, nil
+}
+
+// maxRepeatCount is the largest count of a repeat block. Repeat blocks are expanded into their
+// steps when the routine is parsed, so a larger count would take an unreasonable amount of memory.
+const maxRepeatCount = 10000
+
+// repeatValues returns the value of each iteration of a repeat block, which is either an element
+// of the collection set by for_each or (for count) the index of the iteration.
+func repeatValues(
+	block *hcl.Block, attrs hcl.Attributes, evalCtx *hcl.EvalContext,
+) ([]cty.Value, hcl.Diagnostics) {
+	forEach, hasForEach := attrs["for_each"]
+	count, hasCount := attrs["count"]
+	if hasForEach == hasCount {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid repeat block",
+			Detail:   "A repeat block must set exactly one of for_each or count.",
+			Subject:  block.DefRange.Ptr(),
+		}}
+	}
+
+	if hasCount {
+		// Decoding into an integer would silently truncate fractional counts, so we check them
+		var n float64
+		if diags := gohcl.DecodeExpression(count.Expr, evalCtx, &n); diags.HasErrors() {
+			return nil, diags
+		}
+		if n < 0 || n != math.Trunc(n) || n > maxRepeatCount {
+			return nil, hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid count",
+				Detail: fmt.Sprintf(
+					"The count argument must be a whole number from 0 to %d, such as 3.",
+					maxRepeatCount,
+				),
+				Subject: count.Expr.Range().Ptr(),
+			}}
+		}
+		values := make([]cty.Value, 0, int(n))
+		for i := uint64(0); i < uint64(n); i++ {
+			values = append(values, cty.NumberUIntVal(i))
+		}
+		return values, nil
+	}
+
+	collection, diags := forEach.Expr.Value(evalCtx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if collection.IsNull() || !collection.IsKnown() || !(collection.Type().IsListType() ||
+		collection.Type().IsTupleType() || collection.Type().IsSetType()) {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each",
+			Detail:   "The for_each argument must be a list, such as [\"sample-1\", \"sample-2\"].",
+			Subject:  forEach.Expr.Range().Ptr(),
+		}}
+	}
+	values := make([]cty.Value, 0, collection.LengthInt())
+	for it := collection.ElementIterator(); it.Next(); {
+		_, value := it.Element()
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func invalidDuration(name string, rng hcl.Range) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Invalid " + name,
+		Detail:   "The " + name + " must be a non-negative duration, such as \"90s\" or \"10m\".",
+		Subject:  rng.Ptr(),
+	}
+}
+
+// Steps
+
+func decodeStep(block *hcl.Block, evalCtx *hcl.EvalContext) (step Step, diags hcl.Diagnostics) {
+	step = Step{
+		Kind:    block.Labels[0],
+		Range:   block.DefRange,
+		evalCtx: evalCtx,
+	}
+	var config stepConfig
+	if diags = gohcl.DecodeBody(block.Body, evalCtx, &config); diags.HasErrors() {
+		return step, diags
+	}
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil || timeout < 0 {
+			diags = append(diags, invalidDuration("timeout", step.Range))
+		}
+		step.Timeout = timeout
+	}
+	if !isNull(config.When) {
+		step.when = config.When
+		// The result of the previous step is only known while the routine runs, so we can only
+		// check that the condition is valid for any result
+		_, whenDiags := step.evaluateWhen(cty.UnknownVal(lastType))
+		diags = append(diags, whenDiags...)
+	}
+
+	decode, ok := actionDecoders[step.Kind]
+	if !ok {
+		return step, append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Unknown step kind",
+			Detail: fmt.Sprintf(
+				"The kind of a step must be one of %s, not %q.", strings.Join(actionKinds(), ", "),
+				step.Kind,
+			),
+			Subject: block.LabelRanges[0].Ptr(),
+		})
+	}
+	action, actionDiags := decode(config.Params, evalCtx)
+	step.action = action
+	return step, append(diags, actionDiags...)
+}
+
+// isNull checks whether the expression is absent from its step block or is explicitly null.
+func isNull(expr hcl.Expression) bool {
+	if expr == nil {
+		return true
+	}
+	value, diags := expr.Value(nil)
+	return !diags.HasErrors() && value.IsNull()
+}
+
+// lastType is the type of the result of the previous step, which is available as last in the
+// condition of a step.
+var lastType = cty.Object(map[string]cty.Type{
+	"kind":   cty.String,
+	"status": cty.String,
+	"frames": cty.Number,
+})
+
+// lastValue makes the value of last for the condition of the step after a step with the result.
+func lastValue(kind string, result Result) cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{
+		"kind":   cty.StringVal(kind),
+		"status": cty.StringVal(result.Status),
+		"frames": cty.NumberUIntVal(result.Frames),
+	})
+}
+
+// evaluateWhen evaluates the condition of the step with the result of the previous step, which may
+// be unknown.
+func (s Step) evaluateWhen(last cty.Value) (bool, hcl.Diagnostics) {
+	if s.when == nil {
+		return true, nil
+	}
+	evalCtx := s.evalCtx.NewChild()
+	evalCtx.Variables = map[string]cty.Value{"last": last}
+	value, diags := s.when.Value(evalCtx)
+	if diags.HasErrors() {
+		return false, diags
+	}
+	converted, err := convert.Convert(value, cty.Bool)
+	if err != nil || converted.IsNull() {
+		return false, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid condition",
+			Detail:   "The condition of a step must be true or false.",
+			Subject:  s.when.Range().Ptr(),
+		}}
+	}
+	if !converted.IsKnown() {
+		// The result of the previous step is unknown in a dry run, so we show every step which
+		// might run
+		return true, nil
+	}
+	return converted.True(), nil
+}
@@ -0,0 +1,515 @@
+package routines
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+func TestReadFile(t *testing.T) {
+	routine, err := ReadFile("testdata/routine.hcl", nil)
+	if err != nil {
+		t.Fatalf("couldn't read routine: %s", err)
+	}
+	expected := []struct {
+		kind    string
+		timeout time.Duration
+		action  action
+	}{
+		{
+			kind:    "pump",
+			timeout: 3 * time.Minute,
+			action:  pumpAction{Forward: true, Volume: 1, Flowrate: 6},
+		},
+		{
+			kind:   "camera",
+			action: cameraAction{ISO: 100, ShutterSpeed: 125, AutoWhiteBalance: true},
+		},
+		{
+			kind: "image",
+			action: imageAction{
+				SampleProjectID: "project", SampleID: "sample", Forward: true,
+				StepVolume: 0.04, StepDelay: 0.1, Steps: 2,
+			},
+		},
+		{kind: "wait", action: waitAction{duration: 10 * time.Millisecond}},
+		{
+			kind: "segment",
+			action: segmentAction(planktoscope.PlanktoscopeSegmentingParams{
+				Paths: []string{"/home/pi/data/img/"}, ProcessingID: 1,
+				ExportEcoTaxa: true, KeepObjects: true, Recurse: true,
+			}),
+		},
+	}
+	if len(routine.Steps) != len(expected) {
+		t.Fatalf("routine has %d steps instead of %d", len(routine.Steps), len(expected))
+	}
+	for i, step := range routine.Steps {
+		if step.Kind != expected[i].kind || step.Timeout != expected[i].timeout {
+			t.Errorf(
+				"step %d is a %s step with timeout %s instead of a %s step with timeout %s",
+				i+1, step.Kind, step.Timeout, expected[i].kind, expected[i].timeout,
+			)
+		}
+		if !reflect.DeepEqual(step.action, expected[i].action) {
+			t.Errorf("step %d has action %+v instead of %+v", i+1, step.action, expected[i].action)
+		}
+		if step.Range.Filename != "testdata/routine.hcl" || step.Range.Start.Line == 0 {
+			t.Errorf("step %d has unexpected range %s", i+1, step.Range)
+		}
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  string
+		vars map[string]cty.Value
+		// expected lists substrings of the error, in order.
+		expected []string
+	}{
+		{
+			name:     "syntax error",
+			src:      `step "pump" {`,
+			expected: []string{"couldn't parse routine.hcl"},
+		},
+		{
+			name:     "unknown block",
+			src:      `loop {}`,
+			expected: []string{"couldn't decode routine.hcl", "Unsupported block type"},
+		},
+		{
+			name: "unknown step kind",
+			src:  `step "focus" {}`,
+			expected: []string{
+				"invalid routine in routine.hcl", "routine.hcl:1,6-13: Unknown step kind",
+				"camera, image, pump, segment, wait",
+			},
+		},
+		{
+			name:     "missing parameter",
+			src:      `step "pump" { volume = 1 }`,
+			expected: []string{"Missing required argument", `"flowrate" is required`},
+		},
+		{
+			name:     "unexpected parameter",
+			src:      waitStep(`speed = 2`),
+			expected: []string{"Unsupported argument", `"speed"`},
+		},
+		{
+			name:     "invalid timeout",
+			src:      waitStep(`timeout = "soon"`),
+			expected: []string{"Invalid timeout"},
+		},
+		{
+			name:     "negative timeout",
+			src:      waitStep(`timeout = "-1s"`),
+			expected: []string{"Invalid timeout"},
+		},
+		{
+			name: "invalid pump volume",
+			src: `step "pump" {
+				forward  = true
+				volume   = 0
+				flowrate = 1
+			}`,
+			expected: []string{"Invalid volume"},
+		},
+		{
+			name: "invalid camera settings",
+			src: `step "camera" {
+				iso                = 123
+				shutter_speed      = 125
+				auto_white_balance = true
+			}`,
+			expected: []string{"Invalid camera settings"},
+		},
+		{
+			name: "invalid image steps",
+			src: `step "image" {
+				sample_project_id = "project"
+				sample_id         = "sample"
+				forward           = true
+				step_volume       = 0.04
+				step_delay        = 0.5
+				steps             = 0
+			}`,
+			expected: []string{"Invalid steps"},
+		},
+		{
+			name:     "invalid segment paths",
+			src:      segmentStep(`paths = []`),
+			expected: []string{"Invalid paths"},
+		},
+		{
+			name:     "invalid wait duration",
+			src:      `step "wait" { duration = "10" }`,
+			expected: []string{"Invalid duration"},
+		},
+		{
+			// Every invalid step should be reported at once
+			name: "multiple invalid steps",
+			src: `step "wait" { duration = "-1s" }
+			step "pump" {
+				forward  = true
+				volume   = 1
+				flowrate = -1
+			}`,
+			expected: []string{
+				"routine.hcl:1,", "Invalid duration", "routine.hcl:2,", "Invalid flowrate",
+			},
+		},
+		{
+			name: "duplicate variable",
+			src:  "variables {\n  samples = []\n}\n\nvariables {\n  samples = [\"a\"]\n}",
+			expected: []string{
+				"invalid variables in routine.hcl", "Duplicate variable", `"samples"`,
+			},
+		},
+		{
+			name: "undeclared variable",
+			src:  "variables {\n  samples = []\n}",
+			vars: map[string]cty.Value{"sample": cty.StringVal("a")},
+			expected: []string{
+				"invalid variables in routine.hcl", "Undeclared variable", `"sample"`,
+			},
+		},
+		{
+			name:     "unknown variable",
+			src:      repeatWait(`for_each = var.samples`),
+			expected: []string{"Unsupported attribute", `"samples"`},
+		},
+		{
+			name:     "negative count",
+			src:      repeatWait(`count = -1`),
+			expected: []string{"routine.hcl:2,", "Invalid count"},
+		},
+		{
+			name:     "fractional count",
+			src:      repeatWait(`count = 1.5`),
+			expected: []string{"routine.hcl:2,", "Invalid count"},
+		},
+		{
+			name:     "count above maximum",
+			src:      repeatWait(`count = 10001`),
+			expected: []string{"routine.hcl:2,", "Invalid count"},
+		},
+		{
+			name:     "excessive count",
+			src:      repeatWait(`count = 1e19`),
+			expected: []string{"routine.hcl:2,", "Invalid count", "from 0 to 10000"},
+		},
+		{
+			name:     "non-numeric count",
+			src:      repeatWait(`count = "many"`),
+			expected: []string{"routine.hcl:2,", "a number is required"},
+		},
+		{
+			name:     "string for_each",
+			src:      repeatWait(`for_each = "sample"`),
+			expected: []string{"routine.hcl:2,", "Invalid for_each"},
+		},
+		{
+			name:     "map for_each",
+			src:      repeatWait(`for_each = { sample = "a" }`),
+			expected: []string{"routine.hcl:2,", "Invalid for_each"},
+		},
+		{
+			name:     "for_each and count",
+			src:      repeatWait("for_each = []\n  count = 1"),
+			expected: []string{"Invalid repeat block", "exactly one of for_each or count"},
+		},
+		{
+			name:     "neither for_each nor count",
+			src:      repeatWait(""),
+			expected: []string{"Invalid repeat block", "exactly one of for_each or count"},
+		},
+		{
+			name:     "invalid interval",
+			src:      repeatWait("count = 2\n  interval = \"often\""),
+			expected: []string{"Invalid interval"},
+		},
+		{
+			name:     "invalid step in repeat",
+			src:      "repeat {\n  count = 2\n  step \"wait\" { duration = each.value }\n}",
+			expected: []string{"routine.hcl:3,", "Invalid duration"},
+		},
+		{
+			name:     "string condition",
+			src:      waitStep(`when = "yes"`),
+			expected: []string{"routine.hcl:2,", "Invalid condition"},
+		},
+		{
+			name:     "numeric condition",
+			src:      waitStep(`when = last.frames`),
+			expected: []string{"routine.hcl:2,", "Invalid condition"},
+		},
+		{
+			name:     "unknown attribute in condition",
+			src:      waitStep(`when = last.objects > 0`),
+			expected: []string{"routine.hcl:2,", "Unsupported attribute", `"objects"`},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.src), "routine.hcl", test.vars)
+			if err == nil {
+				t.Fatal("invalid routine was parsed without errors")
+			}
+			checkErrorContains(t, err, test.expected)
+		})
+	}
+}
+
+// waitStep makes the source of a wait step with the attributes, followed by a valid duration.
+func waitStep(attrs string) string {
+	return `step "wait" {
+		` + attrs + `
+		duration = "1s"
+	}`
+}
+
+// repeatWait makes the source of a repeat block with the attributes, around a wait step.
+func repeatWait(attrs string) string {
+	return "repeat {\n  " + attrs + "\n  step \"wait\" { duration = \"1s\" }\n}"
+}
+
+// segmentStep makes the source of a segment step with the attributes, followed by valid values
+// for any other parameters.
+func segmentStep(attrs string) string {
+	return `step "segment" {
+		` + attrs + `
+		processing_id      = 1
+		export_ecotaxa     = true
+		keep_objects       = true
+		recurse            = true
+		force_reprocessing = false
+	}`
+}
+
+// checkErrorContains checks that the error's message contains each of the substrings, in order.
+func checkErrorContains(t *testing.T, err error, substrings []string) {
+	t.Helper()
+	message := err.Error()
+	remaining := message
+	for _, substring := range substrings {
+		i := strings.Index(remaining, substring)
+		if i < 0 {
+			t.Errorf("error %q doesn't contain %q in order", message, substring)
+			return
+		}
+		remaining = remaining[i+len(substring):]
+	}
+}
+
+// describeSteps describes the kind and parameters of each step, e.g. "wait 1s".
+func describeSteps(steps []Step) []string {
+	descriptions := make([]string, 0, len(steps))
+	for _, step := range steps {
+		if a, ok := step.action.(waitAction); ok {
+			descriptions = append(descriptions, "wait "+a.duration.String())
+			continue
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s %+v", step.Kind, step.action))
+	}
+	return descriptions
+}
+
+func TestExpand(t *testing.T) {
+	image := func(sampleID string) string {
+		return "image {SampleProjectID:cruise SampleID:" + sampleID +
+			" Forward:true StepVolume:0.04 StepDelay:0.1 Steps:2}"
+	}
+	segment := func(path string, processingID int) string {
+		return fmt.Sprintf(
+			"segment {Paths:[%s] ProcessingID:%d ExportEcoTaxa:true KeepObjects:true Recurse:true "+
+				"ForceReprocessing:false}",
+			path, processingID,
+		)
+	}
+	for _, test := range []struct {
+		name     string
+		path     string
+		src      string
+		vars     map[string]cty.Value
+		expected []string
+	}{
+		{
+			name: "for_each",
+			path: "testdata/samples.hcl",
+			expected: []string{
+				image("station-1-0"), segment("/home/pi/data/img/cruise/station-1", 0),
+				"wait 10ms",
+				image("station-2-1"), segment("/home/pi/data/img/cruise/station-2", 1),
+			},
+		},
+		{
+			name: "overridden variables",
+			path: "testdata/samples.hcl",
+			vars: map[string]cty.Value{
+				"project": cty.StringVal("lake"),
+				"samples": cty.TupleVal([]cty.Value{cty.StringVal("shore")}),
+			},
+			expected: []string{
+				"image {SampleProjectID:lake SampleID:shore-0 Forward:true StepVolume:0.04 " +
+					"StepDelay:0.1 Steps:2}",
+				segment("/home/pi/data/img/lake/shore", 0),
+			},
+		},
+		{
+			name:     "empty for_each",
+			path:     "testdata/samples.hcl",
+			vars:     map[string]cty.Value{"samples": cty.ListValEmpty(cty.String)},
+			expected: []string{},
+		},
+		{
+			name: "count",
+			src: `repeat {
+				count = 3
+				step "wait" { duration = "${each.value + 1}s" }
+			}`,
+			expected: []string{"wait 1s", "wait 2s", "wait 3s"},
+		},
+		{
+			name: "count from variable",
+			src: `variables {
+				iterations = 2
+			}
+			repeat {
+				count = var.iterations
+				step "wait" { duration = "${each.index}m" }
+			}`,
+			expected: []string{"wait 0s", "wait 1m0s"},
+		},
+		{
+			name: "zero count",
+			src: `repeat {
+				count = 0
+				step "wait" { duration = "1s" }
+			}
+			step "wait" { duration = "2s" }`,
+			expected: []string{"wait 2s"},
+		},
+		{
+			// Inner repeat blocks shadow the each object of outer repeat blocks
+			name: "nested repeat",
+			src: `variables {
+				durations = ["1s", "2s"]
+			}
+			repeat {
+				count    = 2
+				interval = "1m"
+				repeat {
+					for_each = var.durations
+					step "wait" { duration = each.value }
+				}
+			}`,
+			expected: []string{
+				"wait 1s", "wait 2s", "wait 1m0s",
+				"wait 1s", "wait 2s",
+			},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var routine *Routine
+			var err error
+			if test.src != "" {
+				routine, err = Parse([]byte(test.src), "routine.hcl", test.vars)
+			} else {
+				routine, err = ReadFile(test.path, test.vars)
+			}
+			if err != nil {
+				t.Fatalf("couldn't parse routine: %s", err)
+			}
+			if steps := describeSteps(routine.Steps); !reflect.DeepEqual(steps, test.expected) {
+				t.Errorf(
+					"routine has steps\n%s\ninstead of\n%s",
+					strings.Join(steps, "\n"), strings.Join(test.expected, "\n"),
+				)
+			}
+		})
+	}
+}
+
+func TestEvaluateWhen(t *testing.T) {
+	imaged := func(frames uint64) cty.Value {
+		return lastValue("image", Result{Status: planktoscope.StatusDone, Frames: frames})
+	}
+	for _, test := range []struct {
+		name string
+		when string
+		last cty.Value
+		// expectedErr is a substring of the error from evaluating the condition, if it should fail.
+		expectedErr string
+		expected    bool
+	}{
+		{name: "no condition", last: imaged(0), expected: true},
+		{name: "null condition", when: "null", last: imaged(0), expected: true},
+		{name: "true", when: "last.frames >= var.min_frames", last: imaged(5), expected: true},
+		{name: "false", when: "last.frames >= var.min_frames", last: imaged(4)},
+		{
+			name:     "status",
+			when:     `last.kind == "image" && last.status == "Done"`,
+			last:     imaged(0),
+			expected: true,
+		},
+		{
+			// Strings are converted to booleans like in the rest of HCL
+			name: "string", when: `"false"`, last: imaged(0),
+		},
+		{
+			// In a dry run, steps which might run aren't skipped
+			name:     "unknown result",
+			when:     "last.frames >= var.min_frames",
+			last:     cty.UnknownVal(lastType),
+			expected: true,
+		},
+		{
+			// Such conditions can't be checked before the routine runs
+			name:        "non-bool result",
+			when:        "last.status",
+			last:        imaged(0),
+			expectedErr: "Invalid condition",
+		},
+		{
+			name:        "null result",
+			when:        `last.frames > 0 ? true : null`,
+			last:        imaged(0),
+			expectedErr: "Invalid condition",
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			src := "variables {\n  min_frames = 5\n}\n\nstep \"wait\" {\n  duration = \"1s\"\n"
+			if test.when != "" {
+				src += "  when = " + test.when + "\n"
+			}
+			src += "}"
+			routine, err := Parse([]byte(src), "routine.hcl", nil)
+			if err != nil {
+				t.Fatalf("couldn't parse routine: %s", err)
+			}
+			run, diags := routine.Steps[0].evaluateWhen(test.last)
+			if test.expectedErr != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("condition was evaluated as %t without errors", run)
+				}
+				checkErrorContains(t, diags, []string{test.expectedErr})
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("couldn't evaluate condition: %s", diags)
+			}
+			if run != test.expected {
+				t.Errorf("condition was evaluated as %t instead of %t", run, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package routines
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+const (
+	// StepRunning is the state of a step which has started.
+	StepRunning = "running"
+	// StepDone is the state of a step which finished successfully.
+	StepDone = "done"
+	// StepFailed is the state of a step which failed, timed out, or was canceled.
+	StepFailed = "failed"
+	// StepSkipped is the state of a step which didn't run because its condition was false.
+	StepSkipped = "skipped"
+)
+
+// stopTimeout is the maximum time to wait for the PlanktoScope to stop the operation of a step
+// which failed before the operation finished.
+const stopTimeout = 10 * time.Second
+
+// StepReport describes the progress of a step in a routine.
+type StepReport struct {
+	// Index is the position of the step in the routine, starting from 1.
+	Index int `json:"index"`
+	// Steps is the number of steps in the routine.
+	Steps    int           `json:"steps"`
+	Kind     string        `json:"kind"`
+	State    string        `json:"state"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Result   Result        `json:"result"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Run runs the steps of the routine in order, stopping at the first step which fails. Steps whose
+// conditions are false for the result of the previous step which ran are skipped; in a dry run,
+// that result is unknown, so steps whose conditions depend on it aren't skipped. The report
+// function is called when each step starts and when it finishes or is skipped.
+func (r *Routine) Run(
+	ctx context.Context, client *planktoscope.Client, report func(StepReport),
+) error {
+	last := lastValue("", Result{})
+	for i, step := range r.Steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sr := StepReport{
+			Index: i + 1,
+			Steps: len(r.Steps),
+			Kind:  step.Kind,
+		}
+		run, diags := step.evaluateWhen(last)
+		if diags.HasErrors() {
+			return errors.Wrapf(diags, "couldn't evaluate condition of step %d (%s)", i+1, step.Kind)
+		}
+		if !run {
+			sr.State = StepSkipped
+			sr.Start = time.Now()
+			report(sr)
+			continue
+		}
+		result, err := runStep(ctx, client, step, sr, report)
+		if err != nil {
+			return errors.Wrapf(err, "step %d (%s) failed", i+1, step.Kind)
+		}
+		last = lastValue(step.Kind, result)
+		if client.DryRun() {
+			last = cty.UnknownVal(lastType)
+		}
+	}
+	return nil
+}
+
+func runStep(
+	ctx context.Context, client *planktoscope.Client, step Step, sr StepReport,
+	report func(StepReport),
+) (Result, error) {
+	stepCtx, cancel := ctx, context.CancelFunc(func() {})
+	if step.Timeout > 0 {
+		stepCtx, cancel = context.WithTimeout(ctx, step.Timeout)
+	}
+	defer cancel()
+
+	sr.State = StepRunning
+	sr.Start = time.Now()
+	report(sr)
+	result, err := step.action.run(stepCtx, client)
+	sr.Duration = time.Since(sr.Start)
+	sr.Result = result
+	if err != nil && stepCtx.Err() != nil {
+		// The PlanktoScope keeps running the operation even after we stop waiting for it, so we
+		// must stop it explicitly
+		if ctx.Err() == nil {
+			err = errors.Errorf("timed out after %s", step.Timeout)
+		}
+		stopCtx, cancelStop := context.WithTimeout(context.Background(), stopTimeout)
+		if stopErr := step.action.stop(stopCtx, client); stopErr != nil {
+			err = errors.Errorf("%s, and couldn't stop the operation: %s", err, stopErr)
+		}
+		cancelStop()
+	}
+
+	sr.State = StepDone
+	if err != nil {
+		sr.State = StepFailed
+		sr.Error = err.Error()
+	}
+	report(sr)
+	return result, err
+}
@@ -0,0 +1,205 @@
+package routines
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+	"github.com/PlanktoScope/cli/pkg/simulator/simulatortest"
+)
+
+// reports collects the step reports of a routine.
+type reports struct {
+	l       sync.Mutex
+	reports []StepReport
+}
+
+func (r *reports) add(report StepReport) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.reports = append(r.reports, report)
+}
+
+// states returns the kind and state of every report, e.g. "pump running".
+func (r *reports) states() []string {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	states := make([]string, 0, len(r.reports))
+	for _, report := range r.reports {
+		states = append(states, report.Kind+" "+report.State)
+	}
+	return states
+}
+
+func (r *reports) last() StepReport {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	return r.reports[len(r.reports)-1]
+}
+
+func TestRun(t *testing.T) {
+	const longPump = `step "pump" {
+		forward  = true
+		volume   = 100
+		flowrate = 1
+		%s
+	}`
+	for _, test := range []struct {
+		name string
+		// path is the path of the routine file, if src isn't set.
+		path string
+		src  string
+		vars map[string]cty.Value
+		// speed is the speed of the simulated PlanktoScope; operations which shouldn't finish
+		// during the test use the speed of a real PlanktoScope.
+		speed float64
+		// cancelAfter, if positive, is the time after which the routine's context is canceled.
+		cancelAfter time.Duration
+		expected    []string
+		// expectedErr lists substrings of the routine's error, if it should fail.
+		expectedErr []string
+		// expectedResult is the result of the last step.
+		expectedResult Result
+		// expectInterrupted determines whether the pump should be interrupted by the routine.
+		expectInterrupted bool
+	}{
+		{
+			name:  "every kind of step",
+			path:  "testdata/routine.hcl",
+			speed: 1000,
+			expected: []string{
+				"pump running", "pump done", "camera running", "camera done",
+				"image running", "image done", "wait running", "wait done",
+				"segment running", "segment done",
+			},
+			expectedResult: Result{Status: planktoscope.StatusDone, Frames: 2},
+		},
+		{
+			name:  "conditions satisfied",
+			path:  "testdata/samples.hcl",
+			speed: 1000,
+			expected: []string{
+				"image running", "image done", "segment running", "segment done",
+				"wait running", "wait done",
+				"image running", "image done", "segment running", "segment done",
+			},
+			expectedResult: Result{Status: planktoscope.StatusDone, Frames: 2},
+		},
+		{
+			// Conditions depend on the last step which ran, rather than the last skipped step
+			name:  "conditions unsatisfied",
+			path:  "testdata/samples.hcl",
+			vars:  map[string]cty.Value{"min_frames": cty.NumberIntVal(3)},
+			speed: 1000,
+			expected: []string{
+				"image running", "image done", "segment skipped",
+				"wait running", "wait done",
+				"image running", "image done", "segment skipped",
+			},
+		},
+		{
+			name: "non-bool condition",
+			src: `step "wait" { duration = "0s" }
+			step "wait" {
+				duration = "0s"
+				when     = last.status
+			}`,
+			speed:    1000,
+			expected: []string{"wait running", "wait done"},
+			expectedErr: []string{
+				"couldn't evaluate condition of step 2 (wait)", "Invalid condition",
+			},
+		},
+		{
+			name:              "step timeout",
+			src:               fmt.Sprintf(longPump, `timeout = "100ms"`),
+			speed:             1,
+			expected:          []string{"pump running", "pump failed"},
+			expectedErr:       []string{"step 1 (pump) failed", "timed out after 100ms"},
+			expectInterrupted: true,
+		},
+		{
+			// The PlanktoScope should be stopped if the routine is interrupted, e.g. by Ctrl+C
+			name:              "interrupted",
+			src:               fmt.Sprintf(longPump, ""),
+			speed:             1,
+			cancelAfter:       100 * time.Millisecond,
+			expected:          []string{"pump running", "pump failed"},
+			expectedErr:       []string{"step 1 (pump) failed", "context canceled"},
+			expectInterrupted: true,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var routine *Routine
+			var err error
+			if test.src != "" {
+				routine, err = Parse([]byte(test.src), "routine.hcl", test.vars)
+			} else {
+				routine, err = ReadFile(test.path, test.vars)
+			}
+			if err != nil {
+				t.Fatalf("couldn't parse routine: %s", err)
+			}
+			client := simulatortest.NewConnectedClient(t, test.speed)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancelAfter > 0 {
+				time.AfterFunc(test.cancelAfter, cancel)
+			}
+
+			r := &reports{}
+			err = routine.Run(ctx, client, r.add)
+			if test.expectedErr == nil && err != nil {
+				t.Fatalf("routine failed: %s", err)
+			}
+			if test.expectedErr != nil {
+				if err == nil {
+					t.Fatal("routine didn't fail")
+				}
+				checkErrorContains(t, err, test.expectedErr)
+			}
+			if states := r.states(); !reflect.DeepEqual(states, test.expected) {
+				t.Errorf("routine reported %v instead of %v", states, test.expected)
+			}
+			if test.expectedErr == nil && r.last().State != StepSkipped {
+				if result := r.last().Result; result != test.expectedResult {
+					t.Errorf("last step had result %+v instead of %+v", result, test.expectedResult)
+				}
+			}
+			state := client.GetState().Pump
+			if state.Interrupted != test.expectInterrupted {
+				t.Errorf(
+					"pump state %+v doesn't have interrupted %t", state, test.expectInterrupted,
+				)
+			}
+		})
+	}
+}
+
+func TestRunCanceledBeforeStart(t *testing.T) {
+	routine, err := ReadFile("testdata/routine.hcl", nil)
+	if err != nil {
+		t.Fatalf("couldn't read routine: %s", err)
+	}
+	client := simulatortest.NewConnectedClient(t, simulatortest.Speed)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &reports{}
+	if err = routine.Run(ctx, client, r.add); !errors.Is(err, context.Canceled) {
+		t.Errorf("routine returned unexpected error %v", err)
+	}
+	if states := r.states(); len(states) > 0 {
+		t.Errorf("canceled routine reported %v", states)
+	}
+}
@@ -0,0 +1,34 @@
+step "pump" {
+  forward  = true
+  volume   = 1
+  flowrate = 6
+  timeout  = "3m"
+}
+
+step "camera" {
+  iso                = 100
+  shutter_speed      = 125
+  auto_white_balance = true
+}
+
+step "image" {
+  sample_project_id = "project"
+  sample_id         = "sample"
+  forward           = true
+  step_volume       = 0.04
+  step_delay        = 0.1
+  steps             = 2
+}
+
+step "wait" {
+  duration = "10ms"
+}
+
+step "segment" {
+  paths              = ["/home/pi/data/img/"]
+  processing_id      = 1
+  export_ecotaxa     = true
+  keep_objects       = true
+  recurse            = true
+  force_reprocessing = false
+}
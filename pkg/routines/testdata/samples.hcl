@@ -0,0 +1,29 @@
+variables {
+  project    = "cruise"
+  samples    = ["station-1", "station-2"]
+  min_frames = 2
+}
+
+repeat {
+  for_each = var.samples
+  interval = "10ms"
+
+  step "image" {
+    sample_project_id = var.project
+    sample_id         = "${each.value}-${each.index}"
+    forward           = true
+    step_volume       = 0.04
+    step_delay        = 0.1
+    steps             = 2
+  }
+
+  step "segment" {
+    when               = last.frames >= var.min_frames
+    paths              = ["/home/pi/data/img/${var.project}/${each.value}"]
+    processing_id      = each.index
+    export_ecotaxa     = true
+    keep_objects       = true
+    recurse            = true
+    force_reprocessing = false
+  }
+}
@@ -0,0 +1,258 @@
+package simulator
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/pkg/errors"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+// Broker is a minimal MQTT v3.1.1 broker which exchanges messages between network clients and a
+// Bus, so that MQTT clients in other processes can communicate with a simulator. The broker
+// doesn't persist sessions, and it delivers all messages to clients with QoS 0.
+type Broker struct {
+	Bus    *Bus
+	Logger planktoscope.Logger
+
+	listener net.Listener
+	wg       *sync.WaitGroup
+	connsL   *sync.Mutex
+	conns    map[net.Conn]struct{}
+}
+
+func NewBroker(bus *Bus, l planktoscope.Logger) *Broker {
+	return &Broker{
+		Bus:    bus,
+		Logger: l,
+		wg:     &sync.WaitGroup{},
+		connsL: &sync.Mutex{},
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Listen starts accepting MQTT connections over TCP on the address in the background.
+func (b *Broker) Listen(address string) (err error) {
+	if b.listener, err = net.Listen("tcp", address); err != nil {
+		return errors.Wrapf(err, "couldn't listen on %s", address)
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.serve()
+	}()
+	return nil
+}
+
+// Addr returns the address which the broker is listening on.
+func (b *Broker) Addr() net.Addr {
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				b.Logger.Error(errors.Wrap(err, "couldn't accept connection"))
+			}
+			return
+		}
+		b.connsL.Lock()
+		b.conns[conn] = struct{}{}
+		b.connsL.Unlock()
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer func() {
+				b.connsL.Lock()
+				delete(b.conns, conn)
+				b.connsL.Unlock()
+			}()
+			if err := b.handleConn(conn); err != nil {
+				b.Logger.Warn(errors.Wrapf(err, "closed connection from %s", conn.RemoteAddr()))
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections, closes all open connections, and waits for them to finish.
+func (b *Broker) Close() error {
+	if b.listener == nil {
+		return nil
+	}
+	err := b.listener.Close()
+	b.connsL.Lock()
+	for conn := range b.conns {
+		_ = conn.Close()
+	}
+	b.connsL.Unlock()
+	b.wg.Wait()
+	return errors.Wrap(err, "couldn't close listener")
+}
+
+// Connections
+
+// brokerConn is a network client's connection to the broker.
+type brokerConn struct {
+	conn      net.Conn
+	writeL    *sync.Mutex
+	transport *BusTransport
+	logger    planktoscope.Logger
+}
+
+func (c *brokerConn) write(p packets.ControlPacket) error {
+	c.writeL.Lock()
+	defer c.writeL.Unlock()
+
+	return p.Write(c.conn)
+}
+
+func (b *Broker) handleConn(conn net.Conn) error {
+	defer conn.Close()
+
+	c := &brokerConn{
+		conn:      conn,
+		writeL:    &sync.Mutex{},
+		transport: b.Bus.NewTransport(),
+		logger:    b.Logger,
+	}
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		return errors.Wrap(err, "couldn't read connect packet")
+	}
+	connect, ok := p.(*packets.ConnectPacket)
+	if !ok {
+		return errors.Errorf("unexpected first packet %s", p)
+	}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connect.Validate()
+	if err = c.write(connack); err != nil {
+		return errors.Wrap(err, "couldn't acknowledge connection")
+	}
+	if connack.ReturnCode != packets.Accepted {
+		return errors.Errorf("refused connection: %s", packets.ConnackReturnCodes[connack.ReturnCode])
+	}
+	b.Logger.Infof("%s connected from %s", connect.ClientIdentifier, conn.RemoteAddr())
+
+	c.transport.Connect()
+	defer c.transport.Disconnect(0)
+	disconnected, err := c.handlePackets(connect.Keepalive)
+	if !disconnected && connect.WillFlag {
+		c.transport.Publish(connect.WillTopic, connect.WillQos, connect.WillRetain, connect.WillMessage)
+	}
+	b.Logger.Infof("%s disconnected", connect.ClientIdentifier)
+	return err
+}
+
+// handlePackets handles packets from the client until the connection is closed, returning whether
+// the client disconnected normally.
+func (c *brokerConn) handlePackets(keepalive uint16) (disconnected bool, err error) {
+	for {
+		if keepalive > 0 {
+			// Per the MQTT spec, the broker must wait for one and a half keepalive periods
+			const gracePeriod = 3 / 2.0
+			timeout := time.Duration(float64(keepalive) * gracePeriod * float64(time.Second))
+			if err = c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+				return false, errors.Wrap(err, "couldn't set read deadline")
+			}
+		}
+		p, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return false, nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// The client stopped sending packets within its keepalive period, e.g. because it
+				// went away without disconnecting, so the connection is just closed
+				c.logger.Infof("keepalive expired for connection from %s", c.conn.RemoteAddr())
+				return false, nil
+			}
+			return false, errors.Wrap(err, "couldn't read packet")
+		}
+		if _, ok := p.(*packets.DisconnectPacket); ok {
+			return true, nil
+		}
+		if err = c.handlePacket(p); err != nil {
+			return false, errors.Wrapf(err, "couldn't handle packet %s", p)
+		}
+	}
+}
+
+func (c *brokerConn) handlePacket(p packets.ControlPacket) error {
+	switch packet := p.(type) {
+	default:
+		return errors.New("unexpected packet")
+	case *packets.PingreqPacket:
+		return c.write(packets.NewControlPacket(packets.Pingresp))
+	case *packets.PublishPacket:
+		return c.handlePublish(packet)
+	case *packets.PubrelPacket:
+		pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pubcomp.MessageID = packet.MessageID
+		return c.write(pubcomp)
+	case *packets.SubscribePacket:
+		return c.handleSubscribe(packet)
+	case *packets.UnsubscribePacket:
+		for _, topicFilter := range packet.Topics {
+			c.transport.unsubscribe(topicFilter)
+		}
+		unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+		unsuback.MessageID = packet.MessageID
+		return c.write(unsuback)
+	}
+}
+
+func (c *brokerConn) handlePublish(p *packets.PublishPacket) error {
+	// Messages with QoS 2 are delivered upon receipt rather than upon release, which is simpler and
+	// still delivers each message only once because the broker doesn't persist sessions
+	c.transport.Publish(p.TopicName, p.Qos, p.Retain, p.Payload)
+	switch p.Qos {
+	default:
+		return nil
+	case mqttAtLeastOnce:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		return c.write(puback)
+	case mqttExactlyOnce:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.MessageID
+		return c.write(pubrec)
+	}
+}
+
+func (c *brokerConn) handleSubscribe(p *packets.SubscribePacket) error {
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = p.MessageID
+	const grantedQoS = 0
+	suback.ReturnCodes = make([]byte, len(p.Topics))
+	for i := range suback.ReturnCodes {
+		suback.ReturnCodes[i] = grantedQoS
+	}
+	// The subscription must be acknowledged before any retained messages are delivered for it
+	if err := c.write(suback); err != nil {
+		return err
+	}
+	for _, topicFilter := range p.Topics {
+		c.transport.Subscribe(topicFilter, grantedQoS, c.deliver)
+	}
+	return nil
+}
+
+func (c *brokerConn) deliver(m planktoscope.RawMessage) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = m.Topic
+	publish.Retain = m.Retained
+	publish.Payload = []byte(m.Payload)
+	if err := c.write(publish); err != nil {
+		c.logger.Warn(errors.Wrapf(err, "couldn't deliver message on %s", m.Topic))
+		_ = c.conn.Close()
+	}
+}
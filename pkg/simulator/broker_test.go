@@ -0,0 +1,178 @@
+package simulator_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/labstack/gommon/log"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+	"github.com/PlanktoScope/cli/pkg/simulator"
+)
+
+// syncBuffer is a bytes.Buffer which can be written to by concurrent loggers.
+type syncBuffer struct {
+	l   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	return b.buf.String()
+}
+
+// startBroker starts a broker for the bus on a free local port. The test fails if the broker logs
+// any warnings or errors before it's closed.
+func startBroker(t *testing.T, bus *simulator.Bus) *simulator.Broker {
+	t.Helper()
+	logs := &syncBuffer{}
+	logger := log.New("test")
+	logger.SetOutput(logs)
+	logger.SetLevel(log.WARN)
+	broker := simulator.NewBroker(bus, logger)
+	if err := broker.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("couldn't start broker: %s", err)
+	}
+	// Cleanup functions are called in reverse order, so the logs are only checked after all of the
+	// broker's connections have finished
+	t.Cleanup(func() {
+		if output := logs.String(); output != "" {
+			t.Errorf("broker logged warnings or errors: %s", output)
+		}
+	})
+	t.Cleanup(func() {
+		if err := broker.Close(); err != nil {
+			t.Errorf("couldn't close broker: %s", err)
+		}
+	})
+	return broker
+}
+
+func awaitToken(t *testing.T, token mqtt.Token, description string) {
+	t.Helper()
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("timed out waiting to %s", description)
+	}
+	if token.Error() != nil {
+		t.Fatalf("couldn't %s: %s", description, token.Error())
+	}
+}
+
+func awaitPayload(t *testing.T, received <-chan mqtt.Message, topic, payload string) {
+	t.Helper()
+	select {
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for message on %s", topic)
+	case m := <-received:
+		if m.Topic() != topic || string(m.Payload()) != payload {
+			t.Errorf(
+				"received %s on %s instead of %s on %s", m.Payload(), m.Topic(), payload, topic,
+			)
+		}
+	}
+}
+
+func TestBrokerRoundTrip(t *testing.T) {
+	bus := simulator.NewBus()
+	broker := startBroker(t, bus)
+	options := mqtt.NewClientOptions()
+	options.AddBroker("tcp://" + broker.Addr().String())
+	options.SetClientID("broker-test")
+	client := mqtt.NewClient(options)
+	awaitToken(t, client.Connect(), "connect")
+
+	const bufferSize = 8
+	received := make(chan mqtt.Message, bufferSize)
+	awaitToken(t, client.Subscribe("test/#", 2, func(_ mqtt.Client, m mqtt.Message) {
+		received <- m
+	}), "subscribe")
+
+	// Messages published with QoS 2 must complete the PUBREC/PUBREL/PUBCOMP handshake, and must be
+	// delivered to subscriptions of both network clients and bus transports
+	transport := bus.NewTransport()
+	transport.Connect()
+	defer transport.Disconnect(0)
+	busReceived := make(chan planktoscope.RawMessage, bufferSize)
+	transport.Subscribe("test/+", 0, func(m planktoscope.RawMessage) {
+		busReceived <- m
+	})
+	awaitToken(t, client.Publish("test/qos2", 2, false, "exactly once"), "publish with QoS 2")
+	awaitPayload(t, received, "test/qos2", "exactly once")
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message on the bus")
+	case m := <-busReceived:
+		if m.Topic != "test/qos2" || m.Payload != "exactly once" {
+			t.Errorf("bus received %s on %s instead of the published message", m.Payload, m.Topic)
+		}
+	}
+
+	// Messages published on the bus must be delivered to network clients
+	transport.Publish("test/bus", 1, false, []byte("from the bus"))
+	awaitPayload(t, received, "test/bus", "from the bus")
+
+	// Messages must not be delivered after the client unsubscribes
+	awaitToken(t, client.Unsubscribe("test/#"), "unsubscribe")
+	transport.Publish("test/bus", 1, false, []byte("after unsubscribing"))
+	select {
+	case m := <-received:
+		t.Errorf("received message on %s after unsubscribing", m.Topic())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	const quiesce = 100 // ms
+	client.Disconnect(quiesce)
+}
+
+func TestBrokerKeepaliveExpiry(t *testing.T) {
+	bus := simulator.NewBus()
+	broker := startBroker(t, bus)
+	conn, err := net.Dial("tcp", broker.Addr().String())
+	if err != nil {
+		t.Fatalf("couldn't connect to broker: %s", err)
+	}
+	defer conn.Close()
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = "idle-client"
+	connect.Keepalive = 1 // s
+	if err = connect.Write(conn); err != nil {
+		t.Fatalf("couldn't send connect packet: %s", err)
+	}
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("couldn't read connection acknowledgement: %s", err)
+	}
+	if connack, ok := p.(*packets.ConnackPacket); !ok || connack.ReturnCode != packets.Accepted {
+		t.Fatalf("broker didn't accept connection: %s", p)
+	}
+
+	// The broker should close the connection after one and a half keepalive periods without any
+	// packets from the client, without treating that as an error
+	if err = conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("couldn't set read deadline: %s", err)
+	}
+	if p, err = packets.ReadPacket(conn); err == nil {
+		t.Fatalf("received unexpected packet %s", p)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("broker didn't close the connection after the keepalive period")
+	}
+}
@@ -0,0 +1,255 @@
+package simulator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+// Bus is an in-memory message broker which delivers messages between Transports in the same
+// process, so that a client and a simulator can communicate without an MQTT broker.
+type Bus struct {
+	l             *sync.RWMutex
+	subscriptions map[*busSubscription]struct{}
+	retained      map[string]planktoscope.RawMessage
+}
+
+type busSubscription struct {
+	transport *BusTransport
+	inbox     *inbox
+	filter    string
+	handler   func(m planktoscope.RawMessage)
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		l:             &sync.RWMutex{},
+		subscriptions: make(map[*busSubscription]struct{}),
+		retained:      make(map[string]planktoscope.RawMessage),
+	}
+}
+
+// NewTransport makes a new Transport connected to the bus.
+func (b *Bus) NewTransport() *BusTransport {
+	return &BusTransport{
+		bus:        b,
+		connectedL: &sync.RWMutex{},
+		handlersL:  &sync.RWMutex{},
+		inbox:      newInbox(),
+	}
+}
+
+func (b *Bus) publish(m planktoscope.RawMessage) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if m.Retained {
+		if len(m.Payload) == 0 {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m
+		}
+	}
+	// Retained messages are only delivered as retained to new subscriptions, per the MQTT spec
+	m.Retained = false
+	for s := range b.subscriptions {
+		if planktoscope.MatchTopic(s.filter, m.Topic) {
+			s.inbox.push(s.handler, m)
+		}
+	}
+}
+
+func (b *Bus) subscribe(s *busSubscription) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	b.subscriptions[s] = struct{}{}
+	for topic, m := range b.retained {
+		if planktoscope.MatchTopic(s.filter, topic) {
+			s.inbox.push(s.handler, m)
+		}
+	}
+}
+
+func (b *Bus) unsubscribe(t *BusTransport, topicFilter string) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	for s := range b.subscriptions {
+		if s.transport == t && s.filter == topicFilter {
+			delete(b.subscriptions, s)
+		}
+	}
+}
+
+func (b *Bus) unsubscribeAll(t *BusTransport) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	for s := range b.subscriptions {
+		if s.transport == t {
+			delete(b.subscriptions, s)
+		}
+	}
+}
+
+// BusTransport is a planktoscope.Transport which exchanges messages over a Bus.
+type BusTransport struct {
+	bus *Bus
+
+	connected  bool
+	connectedL *sync.RWMutex
+	handlers   planktoscope.ConnectionHandlers
+	handlersL  *sync.RWMutex
+	inbox      *inbox
+}
+
+var errNotConnected = errors.New("not connected to bus")
+
+func (t *BusTransport) SetConnectionHandlers(h planktoscope.ConnectionHandlers) {
+	t.handlersL.Lock()
+	defer t.handlersL.Unlock()
+
+	t.handlers = h
+}
+
+func (t *BusTransport) Connect() planktoscope.Token {
+	t.connectedL.Lock()
+	if t.connected {
+		t.connectedL.Unlock()
+		return planktoscope.NewCompletedToken(nil)
+	}
+	t.connected = true
+	t.inbox = newInbox()
+	go t.inbox.deliver()
+	t.connectedL.Unlock()
+
+	t.handlersL.RLock()
+	onConnect := t.handlers.OnConnect
+	t.handlersL.RUnlock()
+	if onConnect != nil {
+		onConnect()
+	}
+	return planktoscope.NewCompletedToken(nil)
+}
+
+func (t *BusTransport) Disconnect(_ uint) {
+	t.connectedL.Lock()
+	defer t.connectedL.Unlock()
+
+	if !t.connected {
+		return
+	}
+	t.connected = false
+	t.bus.unsubscribeAll(t)
+	t.inbox.close()
+}
+
+func (t *BusTransport) IsConnected() bool {
+	t.connectedL.RLock()
+	defer t.connectedL.RUnlock()
+
+	return t.connected
+}
+
+func (t *BusTransport) IsConnectionOpen() bool {
+	return t.IsConnected()
+}
+
+func (t *BusTransport) Publish(
+	topic string, qos byte, retained bool, payload []byte,
+) planktoscope.Token {
+	if !t.IsConnected() {
+		return planktoscope.NewCompletedToken(errNotConnected)
+	}
+	t.bus.publish(planktoscope.RawMessage{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Received: time.Now(),
+		Payload:  string(payload),
+	})
+	return planktoscope.NewCompletedToken(nil)
+}
+
+func (t *BusTransport) Subscribe(
+	topicFilter string, _ byte, handler func(m planktoscope.RawMessage),
+) planktoscope.Token {
+	if !t.IsConnected() {
+		return planktoscope.NewCompletedToken(errNotConnected)
+	}
+	t.connectedL.RLock()
+	inbox := t.inbox
+	t.connectedL.RUnlock()
+	t.bus.subscribe(&busSubscription{
+		transport: t,
+		inbox:     inbox,
+		filter:    topicFilter,
+		handler:   handler,
+	})
+	return planktoscope.NewCompletedToken(nil)
+}
+
+// unsubscribe removes the transport's subscriptions to the topic filter.
+func (t *BusTransport) unsubscribe(topicFilter string) {
+	t.bus.unsubscribe(t, topicFilter)
+}
+
+// Inbox
+
+type delivery struct {
+	handler func(m planktoscope.RawMessage)
+	message planktoscope.RawMessage
+}
+
+// inbox is an unbounded queue of messages which are delivered in order on a dedicated goroutine,
+// so that message handlers can publish messages without deadlocking the bus.
+type inbox struct {
+	l          *sync.Mutex
+	deliveries []delivery
+	pushed     chan struct{}
+	closed     chan struct{}
+}
+
+func newInbox() *inbox {
+	return &inbox{
+		l:      &sync.Mutex{},
+		pushed: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+func (i *inbox) push(handler func(m planktoscope.RawMessage), m planktoscope.RawMessage) {
+	i.l.Lock()
+	i.deliveries = append(i.deliveries, delivery{handler: handler, message: m})
+	i.l.Unlock()
+
+	select {
+	default:
+	case i.pushed <- struct{}{}:
+	}
+}
+
+func (i *inbox) deliver() {
+	for {
+		select {
+		case <-i.closed:
+			return
+		case <-i.pushed:
+		}
+		i.l.Lock()
+		deliveries := i.deliveries
+		i.deliveries = nil
+		i.l.Unlock()
+		for _, d := range deliveries {
+			d.handler(d.message)
+		}
+	}
+}
+
+func (i *inbox) close() {
+	close(i.closed)
+}
@@ -0,0 +1,401 @@
+// Package simulator provides an in-memory simulation of a PlanktoScope which behaves like the
+// PlanktoScope's Python backend on the MQTT API
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+)
+
+const (
+	mqttAtLeastOnce = 1
+	mqttExactlyOnce = 2
+)
+
+// Config describes the behavior of a simulated PlanktoScope.
+type Config struct {
+	// Speed is the rate at which simulated time passes relative to real time, e.g. 10 makes every
+	// operation finish 10 times faster than on a real PlanktoScope.
+	Speed float64
+	// ImagingFlowrate is the flow rate (in mL/min) of the pump between frames during imaging.
+	ImagingFlowrate float64
+	// CaptureDuration is the time needed to capture and save each frame during imaging.
+	CaptureDuration time.Duration
+	// SegmentationDuration is the time needed to segment each frame.
+	SegmentationDuration time.Duration
+	// ObjectsPerFrame is the number of objects isolated by segmentation in each frame.
+	ObjectsPerFrame uint64
+	// SegmentedFrames is the number of frames to segment if no images have been acquired yet.
+	SegmentedFrames uint64
+}
+
+func DefaultConfig() Config {
+	const (
+		defaultImagingFlowrate      = 2 // mL/min
+		defaultCaptureDuration      = 500 * time.Millisecond
+		defaultSegmentationDuration = 1 * time.Second
+		defaultObjectsPerFrame      = 5
+		defaultSegmentedFrames      = 10
+	)
+	return Config{
+		Speed:                1,
+		ImagingFlowrate:      defaultImagingFlowrate,
+		CaptureDuration:      defaultCaptureDuration,
+		SegmentationDuration: defaultSegmentationDuration,
+		ObjectsPerFrame:      defaultObjectsPerFrame,
+		SegmentedFrames:      defaultSegmentedFrames,
+	}
+}
+
+// job is an operation which the simulated PlanktoScope is running in the background.
+type job struct {
+	cancel context.CancelFunc
+}
+
+// Simulator is a simulated PlanktoScope which responds to commands received over a Transport.
+type Simulator struct {
+	Config    Config
+	Logger    planktoscope.Logger
+	Transport planktoscope.Transport
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+
+	l              *sync.Mutex
+	pump           *job
+	imager         *job
+	segmenter      *job
+	metadata       metadata
+	acquiredFrames uint64
+}
+
+type metadata struct {
+	SampleID      string `json:"sample_id"`
+	AcquisitionID string `json:"acq_id"`
+}
+
+func New(c Config, l planktoscope.Logger, t planktoscope.Transport) *Simulator {
+	return &Simulator{
+		Config:    c,
+		Logger:    l,
+		Transport: t,
+		wg:        &sync.WaitGroup{},
+		l:         &sync.Mutex{},
+	}
+}
+
+// Start connects the simulator to its transport and begins responding to commands.
+func (s *Simulator) Start() error {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	// Subscriptions may not survive a reconnection to the broker (e.g. with a clean session), so
+	// the simulator must subscribe again whenever it connects
+	s.Transport.SetConnectionHandlers(planktoscope.ConnectionHandlers{
+		OnConnect: s.subscribe,
+		OnConnectionLost: func(err error) {
+			s.Logger.Warn(errors.Wrap(err, "lost connection"))
+		},
+	})
+	if token := s.Transport.Connect(); token.Wait() && token.Error() != nil {
+		return errors.Wrap(token.Error(), "couldn't connect")
+	}
+	return nil
+}
+
+// subscribe subscribes to the topics of the commands which the simulator responds to.
+func (s *Simulator) subscribe() {
+	handlers := map[string]func(rawPayload []byte) error{
+		"actuator/pump":     s.handlePumpCommand,
+		"imager/image":      s.handleImagerCommand,
+		"segmenter/segment": s.handleSegmenterCommand,
+	}
+	for topic, handler := range handlers {
+		topic, handler := topic, handler
+		token := s.Transport.Subscribe(topic, mqttExactlyOnce, func(m planktoscope.RawMessage) {
+			if err := handler([]byte(m.Payload)); err != nil {
+				s.Logger.Error(errors.Wrapf(err, "couldn't handle command on %s: %s", topic, m.Payload))
+			}
+		})
+		go func(t planktoscope.Token) {
+			if t.Wait(); t.Error() != nil {
+				s.Logger.Error(errors.Wrapf(t.Error(), "couldn't subscribe to %s", topic))
+			}
+		}(token)
+	}
+}
+
+// Shutdown stops all running operations and disconnects the simulator from its transport.
+func (s *Simulator) Shutdown() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+	const quiesce = 250 // ms
+	s.Transport.Disconnect(quiesce)
+}
+
+// Operations
+
+// startJob runs the operation in the background, replacing any operation already running in the
+// slot.
+func (s *Simulator) startJob(slot **job, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	j := &job{cancel: cancel}
+
+	s.l.Lock()
+	if *slot != nil {
+		(*slot).cancel()
+	}
+	*slot = j
+	s.l.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		run(ctx)
+		s.l.Lock()
+		defer s.l.Unlock()
+		if *slot == j {
+			*slot = nil
+		}
+	}()
+}
+
+// stopJob cancels any operation running in the slot.
+func (s *Simulator) stopJob(slot **job) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if *slot != nil {
+		(*slot).cancel()
+		*slot = nil
+	}
+}
+
+// sleep waits for the simulated duration, returning false if the context was canceled first.
+func (s *Simulator) sleep(ctx context.Context, d time.Duration) bool {
+	if s.Config.Speed > 0 {
+		d = time.Duration(float64(d) / s.Config.Speed)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *Simulator) publish(topic string, payload interface{}) {
+	marshaled, err := json.Marshal(payload)
+	if err != nil {
+		s.Logger.Error(errors.Wrapf(err, "couldn't marshal payload for %s", topic))
+		return
+	}
+	s.Logger.Debugf("%s: %s", topic, marshaled)
+	token := s.Transport.Publish(topic, mqttAtLeastOnce, false, marshaled)
+	if token.Wait(); token.Error() != nil {
+		s.Logger.Error(errors.Wrapf(token.Error(), "couldn't publish to %s", topic))
+	}
+}
+
+type status struct {
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration,omitempty"`
+}
+
+const (
+	startedStatus     = "Started"
+	interruptedStatus = "Interrupted"
+	doneStatus        = "Done"
+)
+
+func parseCommand(rawPayload []byte, command interface{}) error {
+	return errors.Wrap(json.Unmarshal(rawPayload, command), "unparseable payload")
+}
+
+// parseFloat parses a number which the Node-RED dashboard may send as either a string or a number.
+func parseFloat(n interface{}) (float64, error) {
+	switch number := n.(type) {
+	default:
+		return 0, errors.Errorf("unknown float type %T", number)
+	case float64:
+		return number, nil
+	case string:
+		const floatWidth = 64
+		parsed, err := strconv.ParseFloat(number, floatWidth)
+		return parsed, errors.Wrapf(err, "couldn't parse number %s", number)
+	}
+}
+
+// pumpDuration calculates how long the pump takes to move the volume (in mL) at the flowrate (in
+// mL/min).
+func pumpDuration(volume, flowrate float64) time.Duration {
+	if flowrate <= 0 {
+		return 0
+	}
+	return time.Duration(volume / flowrate * float64(time.Minute))
+}
+
+// Pump
+
+func (s *Simulator) handlePumpCommand(rawPayload []byte) error {
+	var command struct {
+		Action    string      `json:"action"`
+		Direction string      `json:"direction"`
+		Volume    interface{} `json:"volume"`
+		Flowrate  interface{} `json:"flowrate"`
+	}
+	if err := parseCommand(rawPayload, &command); err != nil {
+		return err
+	}
+	switch action := command.Action; action {
+	default:
+		return errors.Errorf("unknown action %s", action)
+	case "stop":
+		s.stopJob(&s.pump)
+		s.publish("status/pump", status{Status: interruptedStatus})
+	case "move":
+		volume, err := parseFloat(command.Volume)
+		if err != nil {
+			return errors.Wrap(err, "couldn't parse volume")
+		}
+		flowrate, err := parseFloat(command.Flowrate)
+		if err != nil {
+			return errors.Wrap(err, "couldn't parse flowrate")
+		}
+		if flowrate <= 0 {
+			return errors.Errorf("invalid flowrate %g", flowrate)
+		}
+		duration := pumpDuration(volume, flowrate)
+		s.startJob(&s.pump, func(ctx context.Context) {
+			s.publish("status/pump", status{Status: startedStatus, Duration: duration.Seconds()})
+			if s.sleep(ctx, duration) {
+				s.publish("status/pump", status{Status: doneStatus})
+			}
+		})
+	}
+	return nil
+}
+
+// Imager
+
+func (s *Simulator) handleImagerCommand(rawPayload []byte) error {
+	var command struct {
+		Action     string   `json:"action"`
+		StepVolume float64  `json:"volume"`
+		StepDelay  float64  `json:"sleep"`
+		Steps      uint64   `json:"nb_frame"`
+		Metadata   metadata `json:"config"`
+	}
+	if err := parseCommand(rawPayload, &command); err != nil {
+		return err
+	}
+	switch action := command.Action; action {
+	default:
+		return errors.Errorf("unknown action %s", action)
+	case "stop":
+		s.stopJob(&s.imager)
+		s.publish("status/imager", status{Status: interruptedStatus})
+	case "settings":
+		s.publish("status/imager", status{Status: "Camera settings updated"})
+	case "update_config":
+		s.l.Lock()
+		s.metadata = command.Metadata
+		s.l.Unlock()
+		s.publish("status/imager", status{Status: "Config updated"})
+	case "image":
+		s.l.Lock()
+		m := s.metadata
+		s.acquiredFrames = 0
+		s.l.Unlock()
+		s.startJob(&s.imager, func(ctx context.Context) {
+			s.runImaging(ctx, m, command.StepVolume, command.StepDelay, command.Steps)
+		})
+	}
+	return nil
+}
+
+func (s *Simulator) runImaging(
+	ctx context.Context, m metadata, stepVolume, stepDelay float64, steps uint64,
+) {
+	s.publish("status/imager", status{Status: startedStatus})
+	stepDuration := pumpDuration(stepVolume, s.Config.ImagingFlowrate) +
+		time.Duration(stepDelay*float64(time.Second)) + s.Config.CaptureDuration
+	for frame := uint64(1); frame <= steps; frame++ {
+		if !s.sleep(ctx, stepDuration) {
+			return
+		}
+		s.l.Lock()
+		s.acquiredFrames = frame
+		s.l.Unlock()
+		s.publish("status/imager", status{Status: fmt.Sprintf(
+			"Image %d/%d has been imaged to /home/pi/data/img/%s/%s/%02d.jpg",
+			frame, steps, m.SampleID, m.AcquisitionID, frame,
+		)})
+	}
+	s.publish("status/imager", status{Status: doneStatus})
+}
+
+// Segmenter
+
+func (s *Simulator) handleSegmenterCommand(rawPayload []byte) error {
+	var command struct {
+		Action string `json:"action"`
+	}
+	if err := parseCommand(rawPayload, &command); err != nil {
+		return err
+	}
+	switch action := command.Action; action {
+	default:
+		return errors.Errorf("unknown action %s", action)
+	case "stop":
+		s.stopJob(&s.segmenter)
+		s.publish("status/segmenter", status{Status: interruptedStatus})
+	case "segment":
+		s.l.Lock()
+		frames := s.acquiredFrames
+		s.l.Unlock()
+		if frames == 0 {
+			frames = s.Config.SegmentedFrames
+		}
+		s.startJob(&s.segmenter, func(ctx context.Context) {
+			s.runSegmentation(ctx, frames)
+		})
+	}
+	return nil
+}
+
+func (s *Simulator) runSegmentation(ctx context.Context, frames uint64) {
+	s.publish("status/segmenter", status{Status: startedStatus})
+	s.publish("status/segmenter", status{Status: "Calculating flat"})
+	var object uint64
+	for frame := uint64(1); frame <= frames; frame++ {
+		s.publish("status/segmenter", status{Status: fmt.Sprintf(
+			"Segmenting image %02d.jpg, image %d/%d", frame, frame, frames,
+		)})
+		if !s.sleep(ctx, s.Config.SegmentationDuration) {
+			return
+		}
+		for i := uint64(0); i < s.Config.ObjectsPerFrame; i++ {
+			s.publish("status/segmenter/object_id", struct {
+				ID string `json:"object_id"`
+			}{
+				ID: strconv.FormatUint(object, 10),
+			})
+			object++
+		}
+	}
+	s.publish("status/segmenter", status{Status: doneStatus})
+}
@@ -0,0 +1,144 @@
+package simulator_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+	"github.com/PlanktoScope/cli/pkg/simulator"
+	"github.com/PlanktoScope/cli/pkg/simulator/simulatortest"
+)
+
+func runImaging(client *planktoscope.Client, steps uint64) (planktoscope.ImagingResult, error) {
+	return client.RunImagingActionToCompletion(
+		context.Background(),
+		planktoscope.PlanktoscopeImagingParams{
+			SampleProjectID: "project", SampleID: "sample", Forward: true,
+			StepVolume: 0.04, StepDelay: 0.1, Steps: steps,
+		},
+	)
+}
+
+func runSegmenting(client *planktoscope.Client) (planktoscope.SegmentingResult, error) {
+	return client.RunSegmentingActionToCompletion(
+		context.Background(),
+		planktoscope.PlanktoscopeSegmentingParams{Paths: []string{"/home/pi/data/img"}},
+	)
+}
+
+func TestSimulatorPump(t *testing.T) {
+	client := simulatortest.NewConnectedClient(t, simulatortest.Speed)
+
+	const volume, flowrate = 2, 12 // 10 s at normal speed
+	sent := time.Now()
+	result, err := client.RunPumpActionToCompletion(
+		context.Background(),
+		planktoscope.PlanktoscopePumpParams{Forward: true, Volume: volume, Flowrate: flowrate},
+	)
+	if err != nil {
+		t.Fatalf("pump action failed: %s", err)
+	}
+	if result.Status != planktoscope.StatusDone {
+		t.Errorf(
+			"pump finished with status %s instead of %s", result.Status, planktoscope.StatusDone,
+		)
+	}
+	if duration := 10 * time.Second / simulatortest.Speed; time.Since(sent) < duration {
+		t.Errorf("pump finished sooner than its simulated duration of %s", duration)
+	}
+}
+
+func TestSimulatorImagingAndSegmenting(t *testing.T) {
+	bus := simulator.NewBus()
+	config := simulatortest.Config(simulatortest.Speed)
+	simulatortest.StartSimulator(t, bus, config)
+	client := simulatortest.NewClient(t, bus)
+
+	// Segmentation processes a fixed number of frames if nothing has been imaged yet
+	segmenting, err := runSegmenting(client)
+	if err != nil {
+		t.Fatalf("segmenting action failed: %s", err)
+	}
+	if segmenting.Status != planktoscope.StatusDone || segmenting.Frames != config.SegmentedFrames {
+		t.Errorf(
+			"segmentation finished with result %+v instead of %d frames done",
+			segmenting, config.SegmentedFrames,
+		)
+	}
+
+	const steps = 3
+	imaging, err := runImaging(client, steps)
+	if err != nil {
+		t.Fatalf("imaging action failed: %s", err)
+	}
+	if imaging.Status != planktoscope.StatusDone || imaging.Frames != steps {
+		t.Errorf("imaging finished with result %+v instead of %d frames done", imaging, steps)
+	}
+
+	// Segmentation processes the frames which were just imaged
+	if segmenting, err = runSegmenting(client); err != nil {
+		t.Fatalf("segmenting action failed: %s", err)
+	}
+	if segmenting.Frames != steps {
+		t.Errorf("segmentation processed %d frames instead of %d", segmenting.Frames, steps)
+	}
+	if lastObject := steps*config.ObjectsPerFrame - 1; segmenting.LastObject != lastObject {
+		t.Errorf(
+			"segmentation isolated objects up to %d instead of %d",
+			segmenting.LastObject, lastObject,
+		)
+	}
+}
+
+func TestSimulatorStopImaging(t *testing.T) {
+	// Imaging must still be running when it's stopped
+	client := simulatortest.NewConnectedClient(t, 1)
+
+	type outcome struct {
+		result planktoscope.ImagingResult
+		err    error
+	}
+	outcomes := make(chan outcome, 1)
+	imagerUpdated := client.ImagerStateBroadcasted()
+	go func() {
+		result, err := runImaging(client, 10)
+		outcomes <- outcome{result: result, err: err}
+	}()
+	for !client.GetState().Imager.Imaging {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for imaging to start")
+		case <-imagerUpdated:
+			imagerUpdated = client.ImagerStateBroadcasted()
+		}
+	}
+
+	if err := client.RunStopImagingAction(context.Background()); err != nil {
+		t.Fatalf("couldn't stop imaging: %s", err)
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("imaging action didn't return after imaging was stopped")
+	case o := <-outcomes:
+		if o.err == nil || o.result.Status != planktoscope.StatusInterrupted {
+			t.Errorf("imaging action returned result %+v and error %v", o.result, o.err)
+		}
+	}
+}
+
+func TestSimulatorResubscribesAfterReconnecting(t *testing.T) {
+	bus := simulator.NewBus()
+	transport := simulatortest.StartSimulator(t, bus, simulatortest.Config(simulatortest.Speed))
+	client := simulatortest.NewClient(t, bus)
+
+	// Disconnecting from the bus drops the simulator's subscriptions, like a reconnection to an
+	// MQTT broker with a clean session
+	transport.Disconnect(0)
+	if token := transport.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("couldn't reconnect simulator: %s", token.Error())
+	}
+	if _, err := runImaging(client, 1); err != nil {
+		t.Errorf("imaging action failed after the simulator reconnected: %s", err)
+	}
+}
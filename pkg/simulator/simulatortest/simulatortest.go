@@ -0,0 +1,74 @@
+// Package simulatortest provides fixtures for testing clients against a simulated PlanktoScope.
+package simulatortest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/PlanktoScope/cli/pkg/clients/planktoscope"
+	"github.com/PlanktoScope/cli/pkg/simulator"
+)
+
+// Speed makes simulated operations run quickly enough for tests, e.g. a pump operation of 1 mL at
+// 6 mL/min takes 10 ms.
+const Speed = 1000
+
+// ResponseTimeout is the response timeout of clients made for tests.
+const ResponseTimeout = time.Second
+
+func newLogger() *log.Logger {
+	logger := log.New("test")
+	logger.SetLevel(log.OFF)
+	return logger
+}
+
+// Config returns the default simulator config, with simulated time passing at the speed relative
+// to real time.
+func Config(speed float64) simulator.Config {
+	config := simulator.DefaultConfig()
+	config.Speed = speed
+	return config
+}
+
+// StartSimulator starts a simulated PlanktoScope on the bus, returning the simulator's transport.
+// The simulator is shut down when the test finishes.
+func StartSimulator(
+	t testing.TB, bus *simulator.Bus, config simulator.Config,
+) *simulator.BusTransport {
+	t.Helper()
+	transport := bus.NewTransport()
+	sim := simulator.New(config, newLogger(), transport)
+	if err := sim.Start(); err != nil {
+		t.Fatalf("couldn't start simulator: %s", err)
+	}
+	t.Cleanup(sim.Shutdown)
+	return transport
+}
+
+// NewClient makes a client connected to the bus. The client is closed when the test finishes.
+func NewClient(t testing.TB, bus *simulator.Bus) *planktoscope.Client {
+	t.Helper()
+	client, err := planktoscope.NewClient(
+		planktoscope.Config{ResponseTimeout: ResponseTimeout}, newLogger(),
+		planktoscope.WithTransport(bus.NewTransport()),
+	)
+	if err != nil {
+		t.Fatalf("couldn't make client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("couldn't connect client: %s", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// NewConnectedClient makes a client connected to a simulated PlanktoScope over a new in-memory
+// bus, with simulated time passing at the speed relative to real time.
+func NewConnectedClient(t testing.TB, speed float64) *planktoscope.Client {
+	t.Helper()
+	bus := simulator.NewBus()
+	StartSimulator(t, bus, Config(speed))
+	return NewClient(t, bus)
+}